@@ -0,0 +1,156 @@
+// Package auth 在 Option 协商之后对连接进行认证。
+// 认证消息通过编解码器传输，Header.ServiceMethod 固定为 common.AuthMethod：
+// 客户端先发送携带 Scheme 的消息，服务端根据 Scheme 选择认证器，认证器可以发送挑战并等待客户端回应，
+// 最后服务端返回 Done 消息表示认证成功，或者返回带有错误信息的 Header 并关闭连接
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/felixorbit/fexrpc/codec"
+	"github.com/felixorbit/fexrpc/common"
+)
+
+// Principal 认证通过的主体，会附加到连接上
+type Principal struct {
+	Name   string   // 主体名称，例如 token 对应的用户、HMAC 的 key ID、JWT 的 sub
+	Scheme string   // 认证方式
+	Roles  []string // 主体拥有的角色
+	Claims map[string]interface{}
+}
+
+// Message 认证阶段交换的消息
+type Message struct {
+	Scheme  string
+	Payload []byte
+	Done    bool // 服务端返回，表示认证成功
+}
+
+// Conn 认证阶段的消息通道
+type Conn interface {
+	Send(*Message) error
+	Recv(*Message) error
+}
+
+// Authenticator 服务端认证器，每种认证方式对应一个 Scheme
+type Authenticator interface {
+	Scheme() string
+	// Authenticate 校验客户端发送的第一条消息，需要时可以通过 conn 继续交换消息。成功时返回认证主体，
+	// 返回 nil 主体视为认证失败
+	Authenticate(ctx context.Context, conn Conn, first *Message) (*Principal, error)
+}
+
+// Credentials 客户端凭证，与服务端的 Authenticator 对应
+type Credentials interface {
+	Scheme() string
+	// Handshake 发送凭证，需要时回应服务端的挑战
+	Handshake(conn Conn) error
+}
+
+var (
+	ErrAuthRequired      = errors.New("rpc auth: authentication required")
+	ErrUnsupportedAuth   = errors.New("rpc auth: unsupported authentication scheme")
+	ErrInvalidCredential = errors.New("invalid credentials")
+)
+
+// CodecConn 基于编解码器的消息通道
+type CodecConn struct {
+	cc codec.Codec
+}
+
+var _ Conn = (*CodecConn)(nil)
+
+func NewCodecConn(cc codec.Codec) *CodecConn {
+	return &CodecConn{cc: cc}
+}
+
+func (c *CodecConn) Send(m *Message) error {
+	return c.cc.Write(&codec.Header{ServiceMethod: common.AuthMethod}, m)
+}
+
+func (c *CodecConn) Recv(m *Message) error {
+	var h codec.Header
+	if err := c.cc.ReadHeader(&h); err != nil {
+		return err
+	}
+	if h.Error != "" {
+		_ = c.cc.ReadBody(nil)
+		return errors.New(h.Error)
+	}
+	if h.ServiceMethod != common.AuthMethod {
+		_ = c.cc.ReadBody(nil)
+		return &requestError{seq: h.Seq}
+	}
+	return c.cc.ReadBody(m)
+}
+
+// 认证失败，通知客户端错误原因
+func (c *CodecConn) reject(seq uint64, err error) {
+	_ = c.cc.Write(&codec.Header{
+		ServiceMethod: common.AuthMethod,
+		Seq:           seq,
+		Code:          common.CodeUnauthenticated,
+		Error:         err.Error(),
+	}, struct{}{})
+}
+
+// 认证完成前收到了普通请求
+type requestError struct {
+	seq uint64
+}
+
+func (e *requestError) Error() string {
+	return ErrAuthRequired.Error()
+}
+
+// Serve 服务端执行认证：读取客户端的第一条消息，根据 Scheme 选择认证器。
+// 失败时会向客户端返回错误，调用方应关闭连接
+func Serve(ctx context.Context, conn *CodecConn, authenticators map[string]Authenticator) (*Principal, error) {
+	var first Message
+	if err := conn.Recv(&first); err != nil {
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			conn.reject(reqErr.seq, ErrAuthRequired)
+		}
+		return nil, err
+	}
+	a, ok := authenticators[first.Scheme]
+	if !ok {
+		err := fmt.Errorf("%w: %q", ErrUnsupportedAuth, first.Scheme)
+		conn.reject(0, err)
+		return nil, err
+	}
+	principal, err := a.Authenticate(ctx, conn, &first)
+	if err == nil && principal == nil {
+		err = errors.New("no principal returned")
+	}
+	if err != nil {
+		err = fmt.Errorf("rpc auth: %s authentication failed: %w", first.Scheme, err)
+		conn.reject(0, err)
+		return nil, err
+	}
+	if principal.Scheme == "" {
+		principal.Scheme = first.Scheme
+	}
+	if err = conn.Send(&Message{Scheme: first.Scheme, Done: true}); err != nil {
+		return nil, err
+	}
+	return principal, nil
+}
+
+// Handshake 客户端执行认证，等待服务端返回认证结果
+func Handshake(conn Conn, cred Credentials) error {
+	if err := cred.Handshake(conn); err != nil {
+		return err
+	}
+	var result Message
+	if err := conn.Recv(&result); err != nil {
+		return err
+	}
+	if !result.Done {
+		return errors.New("rpc auth: unexpected message from server")
+	}
+	return nil
+}
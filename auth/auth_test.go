@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/felixorbit/fexrpc/codec"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed:"+msg, v...))
+	}
+}
+
+// 在 net.Pipe 上执行一次认证，返回服务端和客户端的结果
+func handshake(authenticators map[string]Authenticator, cred Credentials) (*Principal, error, error) {
+	cliConn, srvConn := net.Pipe()
+	defer func() {
+		_ = cliConn.Close()
+		_ = srvConn.Close()
+	}()
+	type result struct {
+		p   *Principal
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		p, err := Serve(context.Background(), NewCodecConn(codec.NewGobCodec(srvConn)), authenticators)
+		ch <- result{p, err}
+	}()
+	cliErr := Handshake(NewCodecConn(codec.NewGobCodec(cliConn)), cred)
+	r := <-ch
+	return r.p, r.err, cliErr
+}
+
+func TestToken(t *testing.T) {
+	a := map[string]Authenticator{SchemeToken: NewTokenAuthenticator(map[string]*Principal{
+		"secret": {Name: "alice", Roles: []string{"admin"}},
+	})}
+	p, srvErr, cliErr := handshake(a, TokenCredentials("secret"))
+	_assert(srvErr == nil && cliErr == nil, "expect success, but got %v, %v", srvErr, cliErr)
+	_assert(p.Name == "alice" && p.Scheme == SchemeToken && p.Roles[0] == "admin", "unexpected principal %+v", p)
+
+	_, srvErr, cliErr = handshake(a, TokenCredentials("wrong"))
+	_assert(srvErr != nil && cliErr != nil, "expect rejection for wrong token")
+	_, _, cliErr = handshake(a, JWTCredentials("x.y.z"))
+	_assert(cliErr != nil, "expect rejection for unsupported scheme")
+}
+
+func TestHMAC(t *testing.T) {
+	a := map[string]Authenticator{SchemeHMAC: NewHMACAuthenticator(map[string][]byte{"svc-a": []byte("key")})}
+	p, srvErr, cliErr := handshake(a, &HMACCredentials{KeyID: "svc-a", Secret: []byte("key")})
+	_assert(srvErr == nil && cliErr == nil && p.Name == "svc-a", "expect success, but got %v, %v", srvErr, cliErr)
+	_, srvErr, cliErr = handshake(a, &HMACCredentials{KeyID: "svc-a", Secret: []byte("bad")})
+	_assert(srvErr != nil && cliErr != nil, "expect rejection for wrong secret")
+}
+
+// 认证成功但不返回主体的认证器
+type nilPrincipalAuthenticator struct{}
+
+func (nilPrincipalAuthenticator) Scheme() string { return SchemeToken }
+
+func (nilPrincipalAuthenticator) Authenticate(context.Context, Conn, *Message) (*Principal, error) {
+	return nil, nil
+}
+
+func TestNilPrincipal(t *testing.T) {
+	a := map[string]Authenticator{SchemeToken: nilPrincipalAuthenticator{}}
+	p, srvErr, cliErr := handshake(a, TokenCredentials("secret"))
+	_assert(p == nil && srvErr != nil && cliErr != nil, "nil principal should fail authentication, but got %v, %v", srvErr, cliErr)
+}
+
+func encodeSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHS256(secret []byte, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": "HS256", "typ": "JWT", "kid": kid}) + "." + encodeSegment(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signES256(key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": "ES256", "typ": "JWT"}) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWT(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a := &JWTAuthenticator{
+		Keys:     map[string]interface{}{"k1": []byte("hs-secret"), "": &ecKey.PublicKey},
+		Issuer:   "fexrpc",
+		Audience: "api",
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"sub": "bob", "iss": "fexrpc", "aud": []string{"api"}, "roles": []string{"reader"},
+		"exp": now.Add(time.Hour).Unix(),
+	}
+
+	p, err := a.Authenticate(context.Background(), nil, &Message{Payload: []byte(signHS256([]byte("hs-secret"), "k1", claims))})
+	_assert(err == nil && p.Name == "bob" && len(p.Roles) == 1 && p.Roles[0] == "reader", "HS256: unexpected %+v, %v", p, err)
+	p, err = a.Authenticate(context.Background(), nil, &Message{Payload: []byte(signES256(ecKey, claims))})
+	_assert(err == nil && p.Name == "bob", "ES256: unexpected %+v, %v", p, err)
+
+	_, err = a.Authenticate(context.Background(), nil, &Message{Payload: []byte(signHS256([]byte("other"), "k1", claims))})
+	_assert(err != nil, "expect error for bad signature")
+	_, err = a.Authenticate(context.Background(), nil, &Message{Payload: []byte(signHS256([]byte("hs-secret"), "k2", claims))})
+	_assert(err != nil, "expect error for unknown key")
+
+	expired := map[string]interface{}{"sub": "bob", "iss": "fexrpc", "aud": "api", "exp": now.Add(-time.Hour).Unix()}
+	_, err = a.Authenticate(context.Background(), nil, &Message{Payload: []byte(signHS256([]byte("hs-secret"), "k1", expired))})
+	_assert(err != nil, "expect error for expired token")
+	wrongAud := map[string]interface{}{"sub": "bob", "iss": "fexrpc", "aud": "other"}
+	_, err = a.Authenticate(context.Background(), nil, &Message{Payload: []byte(signHS256([]byte("hs-secret"), "k1", wrongAud))})
+	_assert(err != nil, "expect error for wrong audience")
+
+	// 通过完整的认证流程
+	_, srvErr, cliErr := handshake(map[string]Authenticator{SchemeJWT: a}, JWTCredentials(signES256(ecKey, claims)))
+	_assert(srvErr == nil && cliErr == nil, "expect success, but got %v, %v", srvErr, cliErr)
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+const SchemeHMAC = "hmac"
+
+const nonceSize = 32
+
+// HMACAuthenticator 挑战-应答认证：客户端发送 key ID，服务端返回随机数，客户端用共享密钥对随机数签名
+type HMACAuthenticator struct {
+	keys map[string][]byte // key ID -> 共享密钥
+}
+
+func NewHMACAuthenticator(keys map[string][]byte) *HMACAuthenticator {
+	return &HMACAuthenticator{keys: keys}
+}
+
+func (a *HMACAuthenticator) Scheme() string {
+	return SchemeHMAC
+}
+
+func (a *HMACAuthenticator) Authenticate(_ context.Context, conn Conn, first *Message) (*Principal, error) {
+	keyID := string(first.Payload)
+	secret, ok := a.keys[keyID]
+	if !ok {
+		return nil, ErrInvalidCredential
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	if err := conn.Send(&Message{Scheme: SchemeHMAC, Payload: nonce}); err != nil {
+		return nil, err
+	}
+	var resp Message
+	if err := conn.Recv(&resp); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(resp.Payload, sign(secret, nonce)) {
+		return nil, ErrInvalidCredential
+	}
+	return &Principal{Name: keyID}, nil
+}
+
+func sign(secret, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// HMACCredentials 客户端的 key ID 和共享密钥
+type HMACCredentials struct {
+	KeyID  string
+	Secret []byte
+}
+
+func (c *HMACCredentials) Scheme() string {
+	return SchemeHMAC
+}
+
+func (c *HMACCredentials) Handshake(conn Conn) error {
+	if err := conn.Send(&Message{Scheme: SchemeHMAC, Payload: []byte(c.KeyID)}); err != nil {
+		return err
+	}
+	var challenge Message
+	if err := conn.Recv(&challenge); err != nil {
+		return err
+	}
+	return conn.Send(&Message{Scheme: SchemeHMAC, Payload: sign(c.Secret, challenge.Payload)})
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const SchemeJWT = "jwt"
+
+// JWTAuthenticator 使用本地密钥校验 JWT，支持 HS256 / RS256 / ES256。
+// 主体名称取自 sub，角色取自 roles
+type JWTAuthenticator struct {
+	// Keys 校验签名的密钥，按 JWT header 中的 kid 查找，没有 kid 时使用 key 为 "" 的密钥。
+	// HS256 使用 []byte，RS256 使用 *rsa.PublicKey，ES256 使用 *ecdsa.PublicKey
+	Keys     map[string]interface{}
+	Issuer   string // 不为空时校验 iss
+	Audience string // 不为空时校验 aud
+	Leeway   time.Duration
+}
+
+func (a *JWTAuthenticator) Scheme() string {
+	return SchemeJWT
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (a *JWTAuthenticator) Authenticate(_ context.Context, _ Conn, first *Message) (*Principal, error) {
+	claims, err := a.verify(string(first.Payload), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	p := &Principal{Claims: claims}
+	p.Name, _ = claims["sub"].(string)
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, role := range roles {
+			if r, ok := role.(string); ok {
+				p.Roles = append(p.Roles, r)
+			}
+		}
+	}
+	return p, nil
+}
+
+func (a *JWTAuthenticator) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	key, ok := a.Keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	if err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(a.Leeway)) {
+		return nil, errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	if a.Audience != "" && !hasAudience(claims["aud"], a.Audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func hasAudience(aud interface{}, expect string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == expect
+	case []interface{}:
+		for _, a := range v {
+			if a == expect {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key interface{}, signed, sig []byte) error {
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return errors.New("key type mismatch for HS256")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrInvalidCredential
+		}
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch for RS256")
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return ErrInvalidCredential
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return errors.New("key type or signature size mismatch for ES256")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return ErrInvalidCredential
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	return nil
+}
+
+// JWTCredentials 客户端持有的 JWT
+type JWTCredentials string
+
+func (t JWTCredentials) Scheme() string {
+	return SchemeJWT
+}
+
+func (t JWTCredentials) Handshake(conn Conn) error {
+	return conn.Send(&Message{Scheme: SchemeJWT, Payload: []byte(t)})
+}
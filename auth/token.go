@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+)
+
+const SchemeToken = "token"
+
+// TokenAuthenticator 使用预共享 token 认证，每个 token 对应一个主体
+type TokenAuthenticator struct {
+	tokens map[string]*Principal
+}
+
+func NewTokenAuthenticator(tokens map[string]*Principal) *TokenAuthenticator {
+	return &TokenAuthenticator{tokens: tokens}
+}
+
+func (a *TokenAuthenticator) Scheme() string {
+	return SchemeToken
+}
+
+func (a *TokenAuthenticator) Authenticate(_ context.Context, _ Conn, first *Message) (*Principal, error) {
+	// 逐个比较，避免通过耗时推测 token
+	var matched *Principal
+	for token, principal := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), first.Payload) == 1 {
+			matched = principal
+		}
+	}
+	if matched == nil {
+		return nil, ErrInvalidCredential
+	}
+	p := *matched
+	return &p, nil
+}
+
+// TokenCredentials 客户端的预共享 token
+type TokenCredentials string
+
+func (t TokenCredentials) Scheme() string {
+	return SchemeToken
+}
+
+func (t TokenCredentials) Handshake(conn Conn) error {
+	return conn.Send(&Message{Scheme: SchemeToken, Payload: []byte(t)})
+}
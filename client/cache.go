@@ -0,0 +1,35 @@
+package client
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/felixorbit/fexrpc/codec"
+	"github.com/felixorbit/fexrpc/common"
+)
+
+// 从缓存中解码结果到 reply，未命中时返回 false
+func (c *Client) loadCache(key string, reply interface{}) bool {
+	data, _, ok := c.cache.Get(key, time.Now())
+	if !ok {
+		return false
+	}
+	return gob.NewDecoder(bytes.NewReader(data.([]byte))).Decode(reply) == nil
+}
+
+// 服务端标记结果可缓存时保存一份编码后的副本，调用方之后修改 reply 不影响缓存
+func (c *Client) storeCache(call *Call, h *codec.Header) {
+	if call.cacheKey == "" {
+		return
+	}
+	ttl, err := time.ParseDuration(h.Meta[common.MetaCacheTTL])
+	if err != nil || ttl <= 0 {
+		return
+	}
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(call.Reply); err != nil {
+		return
+	}
+	c.cache.Set(call.cacheKey, buf.Bytes(), time.Now().Add(ttl))
+}
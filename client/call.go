@@ -1,5 +1,11 @@
 package client
 
+import (
+	"time"
+
+	"github.com/felixorbit/fexrpc/trace"
+)
+
 // Call 一次调用 Call 包含：方法名、参数、响应
 // 支持异步调用，通过 Done 通道通知调用方
 type Call struct {
@@ -9,8 +15,15 @@ type Call struct {
 	Reply         interface{}
 	Error         error
 	Done          chan *Call
+
+	meta     map[string]string // 随请求发送的元数据
+	cacheKey string            // 客户端开启缓存时的缓存键
+	target   string            // 服务端地址，用于记录指标
+	start    time.Time         // 发送请求的时间，为零时不记录指标
+	span     *trace.Span       // 客户端 span，调用结束时结束
 }
 
 func (c *Call) done() {
+	c.finish()
 	c.Done <- c
 }
@@ -3,21 +3,23 @@ package client
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/felixorbit/fexrpc/option"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/felixorbit/fexrpc/auth"
 	"github.com/felixorbit/fexrpc/codec"
 	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/internal/dispatch"
+	"github.com/felixorbit/fexrpc/logger"
+	"github.com/felixorbit/fexrpc/memnet"
 )
 
 // Client 维护一次连接
@@ -32,11 +34,28 @@ type Client struct {
 	pending  map[uint64]*Call // 等待响应的请求
 	closing  bool             // 用户主动关闭
 	shutdown bool             // 有错误发生
+	draining bool             // 服务端即将关闭，不再发起新请求
 	target   string
+	services map[string]*dispatch.Service // 客户端注册的服务，供服务端反向调用
+	ctx      context.Context              // 连接断开时取消，反向调用在此基础上执行
+	cancel   context.CancelFunc
+	caps     option.Capability // 与服务端协商后的协议能力
+	cache    *common.Cache     // 服务端标记为可缓存的结果，gob 编码保存，nil 表示不缓存
 }
 
 var ErrShutDown = errors.New("connection is shut down")
 
+// ServerError 服务端返回的错误，Code 表示错误类型
+type ServerError struct {
+	Code       common.Code
+	Msg        string
+	RetryAfter time.Duration // 服务端建议的重试等待时间，0 表示没有建议
+}
+
+func (e *ServerError) Error() string {
+	return e.Msg
+}
+
 func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -47,16 +66,21 @@ func (c *Client) Close() error {
 	return c.cc.Close()
 }
 
+// Capabilities 与服务端协商后双方都支持的协议能力，连接旧版本服务端时为 0
+func (c *Client) Capabilities() option.Capability {
+	return c.caps
+}
+
 func (c *Client) IsAvailable() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return !c.shutdown && !c.closing
+	return !c.shutdown && !c.closing && !c.draining
 }
 
 func (c *Client) registerCall(call *Call) (uint64, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.closing || c.shutdown {
+	if c.closing || c.shutdown || c.draining {
 		return 0, ErrShutDown
 	}
 	call.Seq = c.seq
@@ -79,7 +103,8 @@ func (c *Client) terminateCalls(err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.shutdown = true
-	for _, call := range c.pending {
+	for seq, call := range c.pending {
+		delete(c.pending, seq)
 		call.Error = err
 		call.done()
 	}
@@ -87,34 +112,144 @@ func (c *Client) terminateCalls(err error) {
 
 // 接收响应，处理待处理队列
 func (c *Client) receive() {
+	defer c.cancel()
 	var err error
 	for err == nil {
 		var h codec.Header
 		if err = c.cc.ReadHeader(&h); err != nil {
 			break
 		}
+		if h.Seq == 0 && h.ServiceMethod == common.GoAwayMethod {
+			c.mu.Lock()
+			c.draining = true
+			c.mu.Unlock()
+			err = c.cc.ReadBody(nil)
+			continue
+		}
+		if h.Reverse {
+			err = c.handleReverse(&h)
+			continue
+		}
 		call := c.removeCall(h.Seq)
 		switch {
 		case call == nil:
 			err = c.cc.ReadBody(nil)
 		case h.Error != "":
-			call.Error = fmt.Errorf(h.Error)
+			serverErr := &ServerError{Code: h.Code, Msg: h.Error}
+			serverErr.RetryAfter, _ = time.ParseDuration(h.Meta[common.MetaRetryAfter])
+			call.Error = serverErr
 			err = c.cc.ReadBody(nil)
 			call.done()
 		default:
 			err = c.cc.ReadBody(call.Reply)
 			if err != nil {
 				call.Error = errors.New("reading body " + err.Error())
+			} else {
+				c.storeCache(call, &h)
 			}
 			call.done()
 		}
 	}
+	clientConns.With(c.target).Dec()
 	// 发生错误，中止连接，结束所有调用
 	c.terminateCalls(err)
 }
 
+// Register 在客户端注册服务，服务端可以通过 server.Peer.Call 在该连接上调用
+func (c *Client) Register(obj interface{}) error {
+	return c.register(obj, "")
+}
+
+// RegisterName 使用指定的服务名在客户端注册服务
+func (c *Client) RegisterName(name string, obj interface{}) error {
+	return c.register(obj, name)
+}
+
+func (c *Client) register(obj interface{}, name string) error {
+	svc, err := dispatch.NewService(obj, name)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, dup := c.services[svc.Name]; dup {
+		return errors.New("rpc: service already registered: " + svc.Name)
+	}
+	if c.services == nil {
+		c.services = make(map[string]*dispatch.Service)
+	}
+	c.services[svc.Name] = svc
+	return nil
+}
+
+func (c *Client) findService(serviceMethod string) (*dispatch.Service, *dispatch.Method, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.services) == 0 {
+		return nil, nil, errors.New("rpc client: no service registered on client")
+	}
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot < 0 {
+		return nil, nil, errors.New("rpc client: service/method request ill-formed: " + serviceMethod)
+	}
+	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
+	svc := c.services[serviceName]
+	if svc == nil {
+		return nil, nil, errors.New("rpc client: can't find service " + serviceName)
+	}
+	mtype := svc.Method[methodName]
+	if mtype == nil {
+		return nil, nil, errors.New("rpc client: can't find method " + methodName)
+	}
+	return svc, mtype, nil
+}
+
+// 处理服务端发起的反向调用：在接收协程中读取参数，异步执行并返回响应。
+// 方法的 context 在连接断开时取消
+func (c *Client) handleReverse(h *codec.Header) error {
+	svc, mtype, err := c.findService(h.ServiceMethod)
+	if err != nil {
+		if err := c.cc.ReadBody(nil); err != nil {
+			return err
+		}
+		c.sendReverse(h, common.CodeNotFound, err.Error(), nil)
+		return nil
+	}
+	argv, replyv := mtype.NewArgv(), mtype.NewReplyv()
+	if err = c.cc.ReadBody(dispatch.Body(argv)); err != nil {
+		return err
+	}
+	go func() {
+		err := svc.Call(c.ctx, mtype, argv, replyv)
+		if pe, ok := err.(*dispatch.PanicError); ok {
+			logger.Error("rpc client: panic serving", "method", h.ServiceMethod, "panic", pe.Value, "stack", string(pe.Stack))
+			c.sendReverse(h, common.CodeInternal, "rpc client: internal error serving "+h.ServiceMethod, nil)
+			return
+		}
+		if err != nil {
+			c.sendReverse(h, common.CodeUnknown, err.Error(), nil)
+			return
+		}
+		c.sendReverse(h, common.CodeOK, "", replyv.Interface())
+	}()
+	return nil
+}
+
+func (c *Client) sendReverse(h *codec.Header, code common.Code, errMsg string, reply interface{}) {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	resp := &codec.Header{ServiceMethod: h.ServiceMethod, Seq: h.Seq, Reverse: true, Code: code, Error: errMsg}
+	if reply == nil {
+		reply = struct{}{}
+	}
+	if err := c.cc.Write(resp, reply); err != nil {
+		logger.Warn("rpc client: write reverse response error", "err", err)
+	}
+}
+
 // 发送请求，Call 实例加入待处理队列
 func (c *Client) send(call *Call) {
+	call.begin(c.target)
 	seq, err := c.registerCall(call)
 	if err != nil {
 		call.Error = err
@@ -126,6 +261,7 @@ func (c *Client) send(call *Call) {
 	header := &codec.Header{
 		ServiceMethod: call.ServiceMethod,
 		Seq:           seq,
+		Meta:          call.meta,
 	}
 	if err = c.cc.Write(header, call.Args); err != nil {
 		failedCall := c.removeCall(seq)
@@ -141,7 +277,8 @@ func (c *Client) Go(serviceMethod string, args, reply interface{}, done chan *Ca
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
-		log.Panic("rpc client: done channel is unbuffered")
+		logger.Error("rpc client: done channel is unbuffered")
+		panic("rpc client: done channel is unbuffered")
 	}
 	call := &Call{
 		ServiceMethod: serviceMethod,
@@ -153,28 +290,119 @@ func (c *Client) Go(serviceMethod string, args, reply interface{}, done chan *Ca
 	return call
 }
 
+type idempotencyKeyCtx struct{}
+
+// WithIdempotencyKey 为通过 ctx 发起的调用指定幂等键。服务端在一段时间内对相同的键只执行一次，
+// 重复调用返回第一次调用的结果。服务端没有协商 option.CapIdempotency 时调用返回错误，不会发送请求
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtx{}, key)
+}
+
+type requestIDCtx struct{}
+
+// WithRequestID 为通过 ctx 发起的调用指定请求 ID，服务端在访问日志中记录。服务端不支持元数据时忽略
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDCtx{}, id)
+}
+
 // Call 同步调用，对 Go 封装，阻塞在 Call.Done 等待响应返回。客户端通过 context 进行超时控制
 func (c *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := c.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+	}
+	if c.cache != nil {
+		if key, ok := common.CacheKey(serviceMethod, args); ok {
+			if c.loadCache(key, reply) {
+				return nil
+			}
+			call.cacheKey = key
+		}
+	}
+	if key, _ := ctx.Value(idempotencyKeyCtx{}).(string); key != "" {
+		// 服务端无法识别幂等键时不能保证只执行一次，不发送请求
+		if !c.caps.Has(option.CapMetadata | option.CapIdempotency) {
+			return errors.New("rpc client: server doesn't support idempotency keys")
+		}
+		call.meta = map[string]string{common.MetaIdempotencyKey: key}
+	}
+	if id, _ := ctx.Value(requestIDCtx{}).(string); id != "" && c.caps.Has(option.CapMetadata) {
+		if call.meta == nil {
+			call.meta = make(map[string]string, 1)
+		}
+		call.meta[common.MetaRequestID] = id
+	}
+	if serviceMethod != common.PingMethod {
+		c.startSpan(ctx, call)
+	}
+	c.send(call)
 	select {
 	case <-ctx.Done():
-		c.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		err := fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+		if c.removeCall(call.Seq) != nil {
+			call.Error = err
+			call.finish()
+			go c.cancelCall(call.Seq)
+		}
+		return err
 	case doneCall := <-call.Done:
 		return doneCall.Error
 	}
 }
 
+// 通知服务端取消 seq 对应的调用，服务端不支持时忽略
+func (c *Client) cancelCall(seq uint64) {
+	if !c.caps.Has(option.CapCancellation) {
+		return
+	}
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	_ = c.cc.Write(&codec.Header{ServiceMethod: common.CancelMethod, Seq: seq}, struct{}{})
+}
+
+// 定期发送心跳，心跳失败时关闭连接
+func (c *Client) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !c.IsAvailable() {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := c.Call(ctx, common.PingMethod, struct{}{}, nil)
+		cancel()
+		if err != nil {
+			if c.IsAvailable() {
+				logger.Warn("rpc client: keepalive error", "target", c.target, "err", err)
+				_ = c.Close()
+			}
+			return
+		}
+	}
+}
+
 type newClientFunc func(conn net.Conn, opt *option.Option) (*Client, error)
 
-func newClientCodec(cc codec.Codec, opt *option.Option) *Client {
+func newClientCodec(cc codec.Codec, opt *option.Option, caps option.Capability, target string) *Client {
 	client := &Client{
+		target:  target,
 		seq:     1,
 		cc:      cc,
 		opt:     opt,
 		pending: make(map[uint64]*Call),
+		caps:    caps,
 	}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+	if opt.CacheSize > 0 {
+		client.cache = common.NewCache(opt.CacheSize)
+	}
+	clientConns.With(target).Inc()
 	go client.receive()
+	if opt.KeepAlive > 0 && caps.Has(option.CapKeepalive) {
+		go client.keepalive(opt.KeepAlive)
+	}
 	return client
 }
 
@@ -183,26 +411,25 @@ func NewClient(conn net.Conn, opt *option.Option) (*Client, error) {
 	codecFunc := codec.NewCodecFuncMap[opt.CodecType]
 	if codecFunc == nil {
 		err := fmt.Errorf("invalid codec type: %v", opt.CodecType)
-		log.Println("rpc client: codec error: ", err)
+		logger.Error("rpc client: codec error", "err", err)
 		return nil, err
 	}
-	switch option.OptCodecType {
-	case common.OptionCodecBinary:
-		if err := binary.Write(conn, binary.BigEndian, opt); err != nil {
-			log.Println("rpc client: options error: ", err)
-			_ = conn.Close()
-			return nil, err
-		}
-	case common.OptionCodecJson:
-		// 使用 JSON 协商选项，不定长，可能会读取多余的数据
-		if err := json.NewEncoder(conn).Encode(opt); err != nil {
-			log.Println("rpc client: options error: ", err)
+	hs, err := option.Negotiate(conn, opt)
+	if err != nil {
+		logger.Warn("rpc client: options error", "remote", conn.RemoteAddr(), "err", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	target := conn.RemoteAddr().String()
+	cc := codecFunc(newCountingConn(conn, target))
+	if opt.Credentials != nil {
+		if err := auth.Handshake(auth.NewCodecConn(cc), opt.Credentials); err != nil {
+			logger.Warn("rpc client: authentication error", "remote", conn.RemoteAddr(), "err", err)
 			_ = conn.Close()
 			return nil, err
 		}
 	}
-	clientInst := newClientCodec(codecFunc(conn), opt)
-	clientInst.target = conn.RemoteAddr().String()
+	clientInst := newClientCodec(cc, opt, hs.Capabilities, target)
 	return clientInst, nil
 }
 
@@ -231,6 +458,9 @@ func parseOptions(opts ...*option.Option) (*option.Option, error) {
 	if opt.CodecType == 0 {
 		opt.CodecType = option.DefaultOption.CodecType
 	}
+	if opt.Capabilities == 0 {
+		opt.Capabilities = option.DefaultCapabilities
+	}
 	return opt, nil
 }
 
@@ -239,12 +469,24 @@ type clientResult struct {
 	err    error
 }
 
-func dialTimeout(newFunc newClientFunc, network, address string, opts ...*option.Option) (client *Client, err error) {
+func dialTimeout(newFunc newClientFunc, network, address string, opts ...*option.Option) (*Client, error) {
 	opt, err := parseOptions(opts...)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialTimeout(network, address, opt.ConnectTimeout)
+	client, err := dialOnce(newFunc, network, address, opt)
+	if !errors.Is(err, option.ErrUnsupportedVersion) || opt.ProtocolVersion == 1 {
+		return client, err
+	}
+	// 服务端版本较旧，使用协议版本 1 重新连接，不协商能力。
+	// 没有回复就关闭连接时不降级：无法与拒绝连接区分，需要通过 ProtocolLegacy 显式指定
+	fallback := *opt
+	fallback.ProtocolVersion = 1
+	return dialOnce(newFunc, network, address, &fallback)
+}
+
+func dialOnce(newFunc newClientFunc, network, address string, opt *option.Option) (client *Client, err error) {
+	conn, err := dial(network, address, opt)
 	if err != nil {
 		return nil, err
 	}
@@ -271,6 +513,22 @@ func dialTimeout(newFunc newClientFunc, network, address string, opts ...*option
 	}
 }
 
+// 建立底层连接，mem 使用进程内的内存连接，tls 在 TCP 连接上完成 TLS 握手
+func dial(network, address string, opt *option.Option) (net.Conn, error) {
+	switch network {
+	case memnet.Network:
+		return memnet.DialTimeout(address, opt.ConnectTimeout)
+	case "tls":
+		config := opt.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		return tls.DialWithDialer(&net.Dialer{Timeout: opt.ConnectTimeout}, "tcp", address, config)
+	default:
+		return net.DialTimeout(network, address, opt.ConnectTimeout)
+	}
+}
+
 func Dial(network, address string, opts ...*option.Option) (client *Client, err error) {
 	return dialTimeout(NewClient, network, address, opts...)
 }
@@ -279,16 +537,21 @@ func DialHTTP(network, address string, opts ...*option.Option) (client *Client,
 	return dialTimeout(NewHTTPClient, network, address, opts...)
 }
 
-// XDial 根据协议建立连接，rpcAddr 格式： protocol@addr
+// XDial 根据协议建立连接，rpcAddr 格式： protocol@addr，例如 tcp@127.0.0.1:9999、http@127.0.0.1:9999、
+// tls@127.0.0.1:9999、https@127.0.0.1:9999、unix@/tmp/fexrpc.sock、http+unix@/tmp/fexrpc.sock、mem@name。
+// tls/https 使用 Option.TLSConfig 中的证书配置
 func XDial(rpcAddr string, opts ...*option.Option) (*Client, error) {
-	parts := strings.Split(rpcAddr, "@")
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("rpc client error: wrong format: '%s', expect protocol@addr", rpcAddr)
+	protocol, addr, err := common.ParseRPCAddr(rpcAddr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc client error: %v", err)
 	}
-	protocol, addr := parts[0], parts[1]
 	switch protocol {
 	case "http":
 		return DialHTTP("tcp", addr, opts...)
+	case "http+unix":
+		return DialHTTP("unix", addr, opts...)
+	case "https":
+		return DialHTTP("tls", addr, opts...)
 	default:
 		return Dial(protocol, addr, opts...)
 	}
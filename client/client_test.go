@@ -1,15 +1,28 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/felixorbit/fexrpc/option"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/felixorbit/fexrpc/auth"
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/memnet"
+	"github.com/felixorbit/fexrpc/metrics"
 	"github.com/felixorbit/fexrpc/server"
+	"github.com/felixorbit/fexrpc/trace"
 )
 
 func _assert(condition bool, msg string, v ...interface{}) {
@@ -43,6 +56,16 @@ func (b Bar) Timeout(argv int, reply *int) error {
 	return nil
 }
 
+func (b Bar) Sleep(ms int, reply *int) error {
+	time.Sleep(time.Millisecond * time.Duration(ms))
+	*reply = ms
+	return nil
+}
+
+func (b Bar) Panic(argv int, reply *int) error {
+	panic("boom")
+}
+
 func startServerTest(addr chan string) {
 	var b Bar
 	_ = server.Register(&b)
@@ -60,7 +83,8 @@ func TestClient_Call(t *testing.T) {
 
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		var reply int
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
@@ -73,4 +97,527 @@ func TestClient_Call(t *testing.T) {
 		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
 	})
+	t.Run("server panic", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		var reply int
+		err := client.Call(context.Background(), "Bar.Panic", 1, &reply)
+		serverErr, ok := err.(*ServerError)
+		_assert(ok && serverErr.Code == common.CodeInternal, "expect an internal error, but got %v", err)
+		err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+		_assert(err == nil, "server should keep serving after a panic, but got %v", err)
+	})
+}
+
+func TestClient_ServerShutdown(t *testing.T) {
+	t.Parallel()
+	srv := server.NewServer()
+	var b Bar
+	_ = srv.Register(&b)
+	l, _ := net.Listen("tcp", ":0")
+	go srv.Accept(l)
+
+	t.Run("drain in-flight", func(t *testing.T) {
+		client, _ := Dial("tcp", l.Addr().String())
+		call := client.Go("Bar.Timeout", 1, new(int), nil)
+		time.Sleep(time.Millisecond * 100)
+		shutdownErr := make(chan error, 1)
+		go func() {
+			shutdownErr <- srv.Shutdown(context.Background())
+		}()
+		time.Sleep(time.Millisecond * 100)
+		_assert(!client.IsAvailable(), "client should stop sending new requests after go away")
+		err := client.Call(context.Background(), "Bar.Timeout", 1, new(int))
+		_assert(err == ErrShutDown, "expect shut down error, but got %v", err)
+		doneCall := <-call.Done
+		_assert(doneCall.Error == nil, "in-flight call should finish, but got %v", doneCall.Error)
+		_assert(<-shutdownErr == nil, "expect graceful shutdown")
+		_, err = Dial("tcp", l.Addr().String())
+		_assert(err != nil, "expect dial error after shutdown")
+	})
+}
+
+func TestClient_ServerShutdownTimeout(t *testing.T) {
+	t.Parallel()
+	srv := server.NewServer()
+	var b Bar
+	_ = srv.Register(&b)
+	l, _ := net.Listen("tcp", ":0")
+	go srv.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	call := client.Go("Bar.Timeout", 1, new(int), nil)
+	time.Sleep(time.Millisecond * 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	_assert(err == context.DeadlineExceeded, "expect deadline exceeded, but got %v", err)
+	doneCall := <-call.Done
+	_assert(doneCall.Error != nil, "expect in-flight call to fail after forced close")
+}
+
+func TestClient_ServerConcurrencyLimit(t *testing.T) {
+	t.Parallel()
+	newServer := func() (*server.Server, string) {
+		srv := server.NewServer()
+		var b Bar
+		_ = srv.Register(&b)
+		l, _ := net.Listen("tcp", ":0")
+		go srv.Accept(l)
+		return srv, l.Addr().String()
+	}
+	expectExhausted := func(addr string) {
+		client, _ := Dial("tcp", addr)
+		defer func() { _ = client.Close() }()
+		first := client.Go("Bar.Sleep", 500, new(int), nil)
+		time.Sleep(time.Millisecond * 100)
+		err := client.Call(context.Background(), "Bar.Sleep", 1, new(int))
+		serverErr, ok := err.(*ServerError)
+		_assert(ok && serverErr.Code == common.CodeResourceExhausted, "expect resource exhausted, but got %v", err)
+		_assert((<-first.Done).Error == nil, "first call should succeed")
+		// 响应先于 worker 空闲发出，稍等片刻
+		for i := 0; i < 10; i++ {
+			if err = client.Call(context.Background(), "Bar.Sleep", 1, new(int)); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		_assert(err == nil, "expect success after the first call finished, but got %v", err)
+	}
+
+	t.Run("method", func(t *testing.T) {
+		srv, addr := newServer()
+		defer func() { _ = srv.Close() }()
+		_ = srv.SetMethodConcurrency("Bar.Sleep", 1)
+		expectExhausted(addr)
+	})
+	t.Run("global", func(t *testing.T) {
+		srv, addr := newServer()
+		defer func() { _ = srv.Close() }()
+		srv.SetConcurrency(1, 0)
+		expectExhausted(addr)
+	})
+}
+
+type Greeter struct{}
+
+func (g Greeter) Hello(name string, reply *string) error {
+	*reply = "hello " + name
+	return nil
+}
+
+// Waiter 阻塞到 context 结束，用于检查反向调用的 context 是否随连接取消
+type Waiter struct {
+	started  chan struct{}
+	canceled chan struct{}
+}
+
+func (w Waiter) Wait(ctx context.Context, _ int, reply *int) error {
+	close(w.started)
+	<-ctx.Done()
+	close(w.canceled)
+	return ctx.Err()
+}
+
+func TestClient_ReverseCall(t *testing.T) {
+	t.Parallel()
+	srv := server.NewServer()
+	_ = srv.RegisterFunc("Echo.Callback", func(ctx context.Context, name string, reply *string) error {
+		p, _ := server.PeerFromContext(ctx)
+		return p.Call(ctx, "Greeter.Hello", name, reply)
+	})
+	_ = srv.RegisterFunc("Echo.Block", func(ctx context.Context, _ int, reply *int) error {
+		p, _ := server.PeerFromContext(ctx)
+		return p.Call(context.Background(), "Waiter.Wait", 0, reply)
+	})
+	l, _ := net.Listen("tcp", ":0")
+	go srv.Accept(l)
+	defer func() { _ = srv.Close() }()
+
+	t.Run("registered", func(t *testing.T) {
+		client, _ := Dial("tcp", l.Addr().String())
+		defer func() { _ = client.Close() }()
+		_ = client.Register(Greeter{})
+		var reply string
+		err := client.Call(context.Background(), "Echo.Callback", "fex", &reply)
+		_assert(err == nil && reply == "hello fex", "expect reverse call result, but got %q, %v", reply, err)
+	})
+	t.Run("no service", func(t *testing.T) {
+		client, _ := Dial("tcp", l.Addr().String())
+		defer func() { _ = client.Close() }()
+		var reply string
+		err := client.Call(context.Background(), "Echo.Callback", "fex", &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "no service registered"), "expect error, but got %v", err)
+		err = client.Call(context.Background(), "Bar.Sleep", 1, new(int))
+		_assert(err != nil && strings.Contains(err.Error(), "can't find service"), "connection should stay usable, but got %v", err)
+	})
+	t.Run("canceled with connection", func(t *testing.T) {
+		client, _ := Dial("tcp", l.Addr().String())
+		w := Waiter{started: make(chan struct{}), canceled: make(chan struct{})}
+		_ = client.Register(w)
+		client.Go("Echo.Block", 0, new(int), make(chan *Call, 1))
+		<-w.started
+		_ = client.Close()
+		select {
+		case <-w.canceled:
+		case <-time.After(time.Second):
+			t.Fatal("reverse handler should be canceled when the connection is closed")
+		}
+	})
+	t.Run("not negotiated", func(t *testing.T) {
+		client, _ := Dial("tcp", l.Addr().String(), &option.Option{Capabilities: option.DefaultCapabilities &^ option.CapReverse})
+		defer func() { _ = client.Close() }()
+		_ = client.Register(Greeter{})
+		var reply string
+		err := client.Call(context.Background(), "Echo.Callback", "fex", &reply)
+		_assert(err != nil && err.Error() == server.ErrReverseUnsupported.Error() && reply == "",
+			"reverse call should be refused without CapReverse, but got %q, %v", reply, err)
+	})
+}
+
+type credReply struct {
+	Transport string
+	UID       uint32
+	PID       int32
+}
+
+func TestClient_Unix(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "fexrpc.sock")
+	l, err := server.ListenUnix(path)
+	_assert(err == nil, "listen unix failed: %v", err)
+	srv := server.NewServer()
+	_ = srv.RegisterFunc("Cred.Get", func(ctx context.Context, _ int, reply *credReply) error {
+		p, _ := server.PeerFromContext(ctx)
+		reply.Transport = p.Transport
+		if p.Cred != nil {
+			reply.UID, reply.PID = p.Cred.UID, p.Cred.PID
+		}
+		return nil
+	})
+	go srv.Accept(l)
+	defer func() { _ = srv.Close() }()
+
+	client, err := XDial("unix@" + path)
+	_assert(err == nil, "dial unix failed: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply credReply
+	err = client.Call(context.Background(), "Cred.Get", 0, &reply)
+	_assert(err == nil && reply.Transport == "unix", "expect unix transport, but got %+v, %v", reply, err)
+	if runtime.GOOS == "linux" {
+		_assert(reply.UID == uint32(os.Getuid()) && reply.PID == int32(os.Getpid()), "unexpected peer credential %+v", reply)
+	}
+}
+
+func TestClient_Auth(t *testing.T) {
+	t.Parallel()
+	srv := server.NewServer()
+	srv.SetAuthenticators(auth.NewTokenAuthenticator(map[string]*auth.Principal{"secret": {Name: "alice"}}))
+	_ = srv.RegisterFunc("Auth.Whoami", func(ctx context.Context, _ int, reply *string) error {
+		p, _ := server.PeerFromContext(ctx)
+		*reply = p.Principal.Name
+		return nil
+	})
+	l, _ := net.Listen("tcp", ":0")
+	go srv.Accept(l)
+	defer func() { _ = srv.Close() }()
+
+	client, err := Dial("tcp", l.Addr().String(), &option.Option{Credentials: auth.TokenCredentials("secret")})
+	_assert(err == nil, "dial with token failed: %v", err)
+	var name string
+	err = client.Call(context.Background(), "Auth.Whoami", 0, &name)
+	_assert(err == nil && name == "alice", "expect principal alice, but got %q, %v", name, err)
+
+	_, err = Dial("tcp", l.Addr().String(), &option.Option{Credentials: auth.TokenCredentials("wrong")})
+	_assert(err != nil && strings.Contains(err.Error(), "invalid credentials"), "expect invalid credentials, but got %v", err)
+
+	client, _ = Dial("tcp", l.Addr().String())
+	err = client.Call(context.Background(), "Auth.Whoami", 0, &name)
+	serverErr, ok := err.(*ServerError)
+	_assert(ok && serverErr.Code == common.CodeUnauthenticated, "expect unauthenticated, but got %v", err)
+}
+
+func TestClient_Capabilities(t *testing.T) {
+	s := server.NewServer()
+	canceled := make(chan error, 1)
+	_ = s.RegisterFunc("Block.Wait", func(ctx context.Context, ms int, reply *int) error {
+		select {
+		case <-ctx.Done():
+			canceled <- ctx.Err()
+		case <-time.After(time.Millisecond * time.Duration(ms)):
+		}
+		return nil
+	})
+	s.SetConnTimeouts(0, 0, time.Millisecond*200)
+	l, _ := memnet.Listen("capabilities")
+	go s.Accept(l)
+	defer func() { _ = s.Close() }()
+
+	client, err := XDial("mem@capabilities", &option.Option{KeepAlive: time.Millisecond * 50})
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+	_assert(client.Capabilities() == option.DefaultCapabilities, "unexpected capabilities: %s", client.Capabilities())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	var reply int
+	_ = client.Call(ctx, "Block.Wait", 5000, &reply)
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("server should cancel the call abandoned by client")
+	}
+
+	// 心跳使连接不会因空闲被关闭
+	time.Sleep(time.Millisecond * 400)
+	err = client.Call(context.Background(), "Block.Wait", 0, &reply)
+	_assert(err == nil, "keepalive should keep the connection open, but got %v", err)
+}
+
+func TestClient_ProtocolFallback(t *testing.T) {
+	var b Bar
+	s := server.NewServer()
+	_ = s.Register(&b)
+	l, _ := memnet.Listen("fallback")
+	defer func() { _ = l.Close() }()
+	// 模拟只支持协议版本 1 的服务端
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			lead := make([]byte, 1)
+			_, _ = conn.Read(lead)
+			if lead[0]>>4 != 1 {
+				// 内存连接没有缓冲，丢弃客户端后续写入的 Option，模拟 TCP 的发送缓冲
+				go func() { _, _ = io.Copy(io.Discard, conn) }()
+				// 客户端根据回复的结构而不是拒绝原因判断版本不支持
+				reason := "options error: bad version"
+				_, _ = conn.Write(append([]byte{1, 0, byte(len(reason))}, reason...))
+				_ = conn.Close()
+				continue
+			}
+			go s.ServeConn(&prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(lead), conn)})
+		}
+	}()
+
+	client, err := XDial("mem@fallback")
+	_assert(err == nil, "expect to fall back to protocol version 1, but got %v", err)
+	defer func() { _ = client.Close() }()
+	_assert(client.Capabilities() == 0, "no capability should be negotiated with old server")
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+	_assert(err == nil && reply == 1, "call failed after fallback: %v", err)
+}
+
+func TestClient_LegacyServerFallback(t *testing.T) {
+	var b Bar
+	s := server.NewServer()
+	_ = s.Register(&b)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	// 模拟引入前导字节之前的服务端：直接读取 Option，MagicNumber 不匹配时关闭连接，不回复
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var magic [8]byte
+			if _, err = io.ReadFull(conn, magic[:]); err != nil || binary.BigEndian.Uint64(magic[:]) != option.MagicNumber {
+				_ = conn.Close()
+				continue
+			}
+			go s.ServeConn(&prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(magic[:]), conn)})
+		}
+	}()
+
+	_, err := Dial("tcp", l.Addr().String())
+	_assert(errors.Is(err, option.ErrNoReply), "expect no reply from legacy server, but got %v", err)
+	client, err := Dial("tcp", l.Addr().String(), &option.Option{ProtocolVersion: option.ProtocolLegacy})
+	_assert(err == nil, "expect to connect with the legacy handshake, but got %v", err)
+	defer func() { _ = client.Close() }()
+	_assert(client.Capabilities() == 0, "no capability should be negotiated with legacy server")
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+	_assert(err == nil && reply == 1, "call failed after fallback: %v", err)
+}
+
+func TestClient_MaxConnsRejected(t *testing.T) {
+	var b Bar
+	s := server.NewServer()
+	_ = s.Register(&b)
+	s.SetMaxConns(1)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go s.Accept(l)
+	defer func() { _ = s.Close() }()
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "first connection should be accepted, but got %v", err)
+	defer func() { _ = client.Close() }()
+	_, err = Dial("tcp", l.Addr().String())
+	_assert(errors.Is(err, option.ErrRejected) && strings.Contains(err.Error(), "too many connections"),
+		"connection over the limit should be rejected, but got %v", err)
+}
+
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func TestClient_IdempotencyKey(t *testing.T) {
+	s := server.NewServer()
+	executed := 0
+	_ = s.RegisterFunc("Pay.Charge", func(amount int, reply *int) error {
+		executed++
+		*reply = executed
+		return nil
+	})
+	l, _ := memnet.Listen("idempotency")
+	go s.Accept(l)
+	defer func() { _ = s.Close() }()
+	client, _ := XDial("mem@idempotency")
+	defer func() { _ = client.Close() }()
+
+	ctx := WithIdempotencyKey(context.Background(), "order-1")
+	var r1, r2 int
+	_ = client.Call(ctx, "Pay.Charge", 1, &r1)
+	_ = client.Call(ctx, "Pay.Charge", 1, &r2)
+	_assert(r1 == 1 && r2 == 1 && executed == 1, "retry with the same key should return the first result, got %d %d", r1, r2)
+
+	legacy, _ := XDial("mem@idempotency", &option.Option{ProtocolVersion: 1})
+	defer func() { _ = legacy.Close() }()
+	err := legacy.Call(ctx, "Pay.Charge", 1, &r1)
+	_assert(err != nil && executed == 1, "idempotency key can't be sent without metadata")
+
+	s.SetIdempotency(0, 0)
+	err = client.Call(WithIdempotencyKey(context.Background(), "order-2"), "Pay.Charge", 1, &r1)
+	_assert(err != nil && executed == 1, "server should refuse keyed calls after disabling idempotency, but got %v", err)
+	disabled, _ := XDial("mem@idempotency")
+	defer func() { _ = disabled.Close() }()
+	_assert(!disabled.Capabilities().Has(option.CapIdempotency), "idempotency shouldn't be negotiated after disabled")
+	err = disabled.Call(WithIdempotencyKey(context.Background(), "order-3"), "Pay.Charge", 1, &r1)
+	_assert(err != nil && executed == 1, "keyed call should fail without idempotency capability, but got %v", err)
+}
+
+func TestClient_Cache(t *testing.T) {
+	s := server.NewServer()
+	_ = s.RegisterFunc("Geo.Lookup", func(id int, reply *string) error {
+		*reply = fmt.Sprintf("city-%d", id)
+		return nil
+	}, &option.MethodOption{CacheTTL: time.Minute})
+	l, _ := memnet.Listen("cache")
+	go s.Accept(l)
+	client, _ := XDial("mem@cache", &option.Option{CacheSize: 10})
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	_ = client.Call(context.Background(), "Geo.Lookup", 1, &reply)
+	_assert(reply == "city-1", "unexpected reply %q", reply)
+	// 服务端关闭后仍然可以从客户端缓存获取结果
+	_ = s.Close()
+	reply = ""
+	err := client.Call(context.Background(), "Geo.Lookup", 1, &reply)
+	_assert(err == nil && reply == "city-1", "expect reply from client cache, but got %q %v", reply, err)
+	err = client.Call(context.Background(), "Geo.Lookup", 2, &reply)
+	_assert(err != nil, "uncached call should fail after server closed")
+}
+
+func TestClient_Metrics(t *testing.T) {
+	s := server.NewServer()
+	var b Bar
+	_ = s.Register(&b)
+	// 指标记录在全局的 metrics.Default 中，每次运行使用不同的地址
+	name := fmt.Sprintf("metrics-%d", time.Now().UnixNano())
+	l, err := memnet.Listen(name)
+	_assert(err == nil, "listen failed: %v", err)
+	defer func() { _ = l.Close() }()
+	go s.Accept(l)
+	defer func() { _ = s.Close() }()
+	client, err := XDial("mem@" + name)
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	_ = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+	_ = client.Call(context.Background(), "Bar.Missing", 1, &reply)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_ = client.Call(ctx, "Bar.Sleep", 500, &reply)
+
+	var text strings.Builder
+	_ = metrics.Default.WriteText(&text)
+	target := client.target
+	for _, line := range []string{
+		fmt.Sprintf(`fexrpc_client_requests_total{target="%s",method="Bar.Sleep"} 2`, target),
+		fmt.Sprintf(`fexrpc_client_errors_total{target="%s",method="Bar.Missing",code="not found"} 1`, target),
+		fmt.Sprintf(`fexrpc_client_errors_total{target="%s",method="Bar.Sleep",code="deadline exceeded"} 1`, target),
+		fmt.Sprintf(`fexrpc_client_in_flight_requests{target="%s",method="Bar.Sleep"} 0`, target),
+		fmt.Sprintf(`fexrpc_client_connections{target="%s"} 1`, target),
+	} {
+		_assert(strings.Contains(text.String(), line), "expect %q in metrics:\n%s", line, text.String())
+	}
+	_assert(strings.Contains(text.String(), fmt.Sprintf(`fexrpc_client_sent_bytes_total{target="%s"}`, target)), "expect sent bytes")
+}
+
+// 记录导出的 span
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []trace.SpanData
+}
+
+func (r *spanRecorder) Export(span trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func (r *spanRecorder) find(name string, kind trace.Kind) (trace.SpanData, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, span := range r.spans {
+		if span.Name == name && span.Kind == kind {
+			return span, true
+		}
+	}
+	return trace.SpanData{}, false
+}
+
+func TestClient_Trace(t *testing.T) {
+	rec := &spanRecorder{}
+	trace.SetExporter(rec)
+	defer trace.SetExporter(nil)
+	s := server.NewServer()
+	_ = s.RegisterFunc("Trace.Echo", func(ctx context.Context, _ int, reply *string) error {
+		*reply = trace.FromContext(ctx).SpanContext().TraceID.String()
+		return nil
+	})
+	l, _ := memnet.Listen("trace")
+	go s.Accept(l)
+	defer func() { _ = s.Close() }()
+	client, _ := XDial("mem@trace")
+	defer func() { _ = client.Close() }()
+
+	ctx, parent := trace.StartSpan(context.Background(), "request", trace.KindInternal)
+	var reply string
+	err := client.Call(ctx, "Trace.Echo", 1, &reply)
+	parent.End()
+	_assert(err == nil && reply == parent.SpanContext().TraceID.String(), "server should continue the trace, got %q %v", reply, err)
+
+	cli, ok := rec.find("Trace.Echo", trace.KindClient)
+	_assert(ok && cli.ParentID == parent.SpanContext().SpanID && cli.Attributes[trace.AttrPeer] == client.target,
+		"unexpected client span %+v", cli)
+	// 服务端 span 在响应发送后结束
+	var srv trace.SpanData
+	for i := 0; i < 50; i++ {
+		if srv, ok = rec.find("Trace.Echo", trace.KindServer); ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(ok && srv.TraceID == cli.TraceID && srv.ParentID == cli.SpanID && srv.Status == "ok", "unexpected server span %+v", srv)
 }
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/metrics"
+)
+
+// 客户端指标记录在 metrics.Default 中，按服务端地址和方法区分
+var (
+	clientRequests = metrics.Default.Counter("fexrpc_client_requests_total",
+		"Calls sent by target and method.", "target", "method")
+	clientErrors = metrics.Default.Counter("fexrpc_client_errors_total",
+		"Calls that failed by target, method and code.", "target", "method", "code")
+	clientLatency = metrics.Default.Histogram("fexrpc_client_request_duration_seconds",
+		"Time from sending a call to receiving its response.", nil, "target", "method")
+	clientInFlight = metrics.Default.Gauge("fexrpc_client_in_flight_requests",
+		"Calls waiting for a response.", "target", "method")
+	clientBytesIn = metrics.Default.Counter("fexrpc_client_received_bytes_total",
+		"Bytes read from the connection by target.", "target")
+	clientBytesOut = metrics.Default.Counter("fexrpc_client_sent_bytes_total",
+		"Bytes written to the connection by target.", "target")
+	clientConns = metrics.Default.Gauge("fexrpc_client_connections",
+		"Connections currently open by target.", "target")
+)
+
+// 发送请求前记录
+func (call *Call) begin(target string) {
+	call.target, call.start = target, time.Now()
+	clientRequests.With(target, call.ServiceMethod).Inc()
+	clientInFlight.With(target, call.ServiceMethod).Inc()
+}
+
+// 调用结束时记录指标并结束 span，包括调用方放弃等待的情况
+func (call *Call) finish() {
+	if call.start.IsZero() {
+		return
+	}
+	if call.span != nil {
+		if call.Error != nil {
+			call.span.SetStatus(errorCode(call.Error), call.Error.Error())
+		}
+		call.span.End()
+	}
+	clientInFlight.With(call.target, call.ServiceMethod).Dec()
+	clientLatency.With(call.target, call.ServiceMethod).Observe(time.Since(call.start).Seconds())
+	if call.Error != nil {
+		clientErrors.With(call.target, call.ServiceMethod, errorCode(call.Error).String()).Inc()
+	}
+}
+
+// 客户端错误对应的状态码，服务端返回的错误使用响应中的状态码，本地错误视为服务不可用
+func errorCode(err error) common.Code {
+	var se *ServerError
+	switch {
+	case errors.As(err, &se):
+		return se.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return common.CodeDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return common.CodeCanceled
+	default:
+		return common.CodeUnavailable
+	}
+}
+
+// countingConn 统计连接读写的字节数
+type countingConn struct {
+	net.Conn
+	in, out metrics.Counter
+}
+
+func newCountingConn(conn net.Conn, target string) *countingConn {
+	return &countingConn{Conn: conn, in: clientBytesIn.With(target), out: clientBytesOut.With(target)}
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/felixorbit/fexrpc/option"
+	"github.com/felixorbit/fexrpc/server"
+)
+
+// 测试用的 CA，用于签发服务端和客户端证书
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA() *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fexrpc test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// 签发证书，返回 PEM 编码的证书和私钥
+func (ca *testCA) issue(cn string, serial int64) (certPEM, keyPEM []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) writeFiles(dir, cn string, serial int64) (certFile, keyFile string) {
+	certPEM, keyPEM := ca.issue(cn, serial)
+	certFile, keyFile = filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key")
+	_ = os.WriteFile(certFile, certPEM, 0600)
+	_ = os.WriteFile(keyFile, keyPEM, 0600)
+	return
+}
+
+type tlsReply struct {
+	Transport string
+	Identity  string
+}
+
+func TestClient_MutualTLS(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	ca := newTestCA()
+	serverCert, serverKey := ca.writeFiles(dir, "server", 2)
+	clientCert, clientKey := ca.writeFiles(dir, "client", 3)
+
+	reloader, err := server.NewCertReloader(serverCert, serverKey)
+	_assert(err == nil, "load server cert failed: %v", err)
+	srv := server.NewServer()
+	_ = srv.RegisterFunc("TLS.Who", func(ctx context.Context, _ int, reply *tlsReply) error {
+		p, _ := server.PeerFromContext(ctx)
+		*reply = tlsReply{Transport: p.Transport, Identity: p.TLSIdentity}
+		return nil
+	})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go srv.AcceptTLS(l, server.NewTLSConfig(reloader, ca.pool))
+	defer func() { _ = srv.Close() }()
+
+	cert, _ := tls.LoadX509KeyPair(clientCert, clientKey)
+	clientConfig := &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{cert}}
+	client, err := XDial("tls@"+l.Addr().String(), &option.Option{TLSConfig: clientConfig})
+	_assert(err == nil, "dial tls failed: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply tlsReply
+	err = client.Call(context.Background(), "TLS.Who", 0, &reply)
+	_assert(err == nil && reply.Transport == "tls" && reply.Identity == "client",
+		"expect verified client identity, but got %+v, %v", reply, err)
+
+	t.Run("no client cert", func(t *testing.T) {
+		client, err := XDial("tls@"+l.Addr().String(), &option.Option{TLSConfig: &tls.Config{RootCAs: ca.pool}})
+		if err == nil {
+			err = client.Call(context.Background(), "TLS.Who", 0, new(tlsReply))
+		}
+		_assert(err != nil, "expect error without client certificate")
+	})
+
+	t.Run("hot reload", func(t *testing.T) {
+		certPEM, keyPEM := ca.issue("server", 42)
+		_ = os.WriteFile(serverCert, certPEM, 0600)
+		_ = os.WriteFile(serverKey, keyPEM, 0600)
+		future := time.Now().Add(time.Minute)
+		_ = os.Chtimes(serverCert, future, future)
+		conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+		_assert(err == nil, "tls dial failed: %v", err)
+		defer func() { _ = conn.Close() }()
+		serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+		_assert(serial == 42, "expect reloaded certificate, but got serial %d", serial)
+	})
+}
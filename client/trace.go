@@ -0,0 +1,26 @@
+package client
+
+import (
+	"context"
+
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/option"
+	"github.com/felixorbit/fexrpc/trace"
+)
+
+// 在 ctx 中的 span 下为调用创建客户端 span，服务端支持元数据时通过 traceparent 传递追踪上下文
+func (c *Client) startSpan(ctx context.Context, call *Call) {
+	_, call.span = trace.StartSpan(ctx, call.ServiceMethod, trace.KindClient)
+	call.span.SetAttribute(trace.AttrMethod, call.ServiceMethod)
+	call.span.SetAttribute(trace.AttrPeer, c.target)
+	if id := call.meta[common.MetaRequestID]; id != "" {
+		call.span.SetAttribute(trace.AttrRequestID, id)
+	}
+	if !c.caps.Has(option.CapMetadata) {
+		return
+	}
+	if call.meta == nil {
+		call.meta = make(map[string]string, 1)
+	}
+	call.meta[common.MetaTraceparent] = call.span.SpanContext().Traceparent()
+}
@@ -1,13 +1,19 @@
 package codec
 
 import (
+	"fmt"
 	"io"
+
+	"github.com/felixorbit/fexrpc/common"
 )
 
 type Header struct {
 	ServiceMethod string
 	Seq           uint64
 	Error         string
+	Code          common.Code       // Error 不为空时表示错误类型
+	Reverse       bool              // 服务端发起的反向调用及其响应，与正向调用使用各自的 Seq
+	Meta          map[string]string // 扩展元数据，键见 common.Meta*
 }
 
 // Codec 编解码器接口
@@ -29,6 +35,17 @@ const (
 	JsonType
 )
 
+func (t CType) String() string {
+	switch t {
+	case GobType:
+		return "gob"
+	case JsonType:
+		return "json"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint64(t))
+	}
+}
+
 var NewCodecFuncMap map[CType]NewCodecFunc
 
 func init() {
@@ -4,7 +4,8 @@ import (
 	"bufio"
 	"encoding/json"
 	"io"
-	"log"
+
+	"github.com/felixorbit/fexrpc/logger"
 )
 
 type JsonCodec struct {
@@ -43,11 +44,11 @@ func (g *JsonCodec) Write(header *Header, body interface{}) (err error) {
 		}
 	}()
 	if err = g.enc.Encode(header); err != nil {
-		log.Println("rpc codec: json error encoding header: ", err)
+		logger.Error("rpc codec: json error encoding header", "err", err)
 		return err
 	}
 	if err = g.enc.Encode(body); err != nil {
-		log.Println("rpc codec: json error encoding body: ", err)
+		logger.Error("rpc codec: json error encoding body", "err", err)
 		return err
 	}
 	return nil
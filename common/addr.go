@@ -0,0 +1,16 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseRPCAddr 解析 protocol@addr 格式的服务地址，例如 tcp@127.0.0.1:9999、unix@/tmp/fexrpc.sock。
+// 只按第一个 @ 分割，addr 中可以包含 @
+func ParseRPCAddr(rpcAddr string) (protocol, addr string, err error) {
+	protocol, addr, ok := strings.Cut(rpcAddr, "@")
+	if !ok || protocol == "" || addr == "" {
+		return "", "", fmt.Errorf("wrong format: '%s', expect protocol@addr", rpcAddr)
+	}
+	return protocol, addr, nil
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Cache 带过期时间的有界缓存，超过容量时淘汰最早加入的条目，并发安全
+type Cache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // 按加入顺序排列
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func NewCache(maxEntries int) *Cache {
+	return &Cache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Get 获取未过期的值及其过期时间
+func (c *Cache) Get(key string, now time.Time) (interface{}, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	e := elem.Value.(*cacheEntry)
+	if now.After(e.expires) {
+		c.remove(elem)
+		return nil, time.Time{}, false
+	}
+	return e.value, e.expires, true
+}
+
+// Set 保存值，已存在时替换
+func (c *Cache) Set(key string, value interface{}, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.order.Len() > 0 && c.order.Len() >= c.maxEntries {
+		c.remove(c.order.Front())
+	}
+	c.entries[key] = c.order.PushBack(&cacheEntry{key: key, value: value, expires: expires})
+}
+
+// Len 缓存的条目数，包括已过期但还未淘汰的条目
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// CacheKey 根据方法名和参数生成缓存键，客户端和服务端使用相同的规则。
+// 参数使用 JSON 编码，相同的参数得到相同的键，无法编码时返回 false
+func CacheKey(serviceMethod string, args interface{}) (string, bool) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return "", false
+	}
+	return serviceMethod + "|" + string(data), true
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
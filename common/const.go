@@ -4,6 +4,18 @@ const (
 	Connected        = "200 Connected to Fex RPC"
 	DefaultRPCPath   = "/_fexrpc_"
 	DefaultDebugPath = "/debug/fexrpc"
+	// DefaultDebugJSONPath JSON 格式的调试信息：方法耗时分位数、错误统计、活跃连接和运行时长
+	DefaultDebugJSONPath = "/debug/fexrpc/json"
+	// DefaultMetricsPath Prometheus 文本格式的指标，包括服务端和同一进程内客户端的指标
+	DefaultMetricsPath = "/debug/fexrpc/metrics"
+	// GoAwayMethod 服务端关闭前发送的通知，Seq 固定为 0
+	GoAwayMethod = "_fexrpc_.GoAway"
+	// AuthMethod 认证阶段交换消息使用的方法名
+	AuthMethod = "_fexrpc_.Auth"
+	// CancelMethod 客户端放弃调用时通知服务端，Seq 为被取消的请求，服务端不回复
+	CancelMethod = "_fexrpc_.Cancel"
+	// PingMethod 客户端心跳，服务端直接回复
+	PingMethod = "_fexrpc_.Ping"
 )
 
 const (
@@ -11,3 +23,21 @@ const (
 	OptionCodecJson   = 2
 	OptionCodecPb     = 3
 )
+
+// Header.Meta 中使用的键
+const (
+	// MetaRetryAfter 请求被限流时建议的重试等待时间，格式同 time.Duration.String
+	MetaRetryAfter = "retry-after"
+	// MetaIdempotencyKey 请求的幂等键，相同的键只执行一次
+	MetaIdempotencyKey = "idempotency-key"
+	// MetaIdempotentReplay 响应是相同幂等键的第一次调用的结果
+	MetaIdempotentReplay = "idempotent-replay"
+	// MetaCacheTTL 响应可以被客户端缓存的时间，格式同 time.Duration.String
+	MetaCacheTTL = "cache-ttl"
+	// MetaCacheHit 响应来自服务端缓存
+	MetaCacheHit = "cache-hit"
+	// MetaRequestID 请求 ID，记录在访问日志中
+	MetaRequestID = "request-id"
+	// MetaTraceparent 调用方的追踪上下文，格式同 W3C traceparent
+	MetaTraceparent = "traceparent"
+)
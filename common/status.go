@@ -0,0 +1,39 @@
+package common
+
+// Code 响应的状态码，随 Header 返回给客户端
+type Code uint32
+
+const (
+	CodeOK Code = iota
+	CodeUnknown
+	CodeInvalidArgument
+	CodeNotFound
+	CodeDeadlineExceeded
+	CodeResourceExhausted
+	CodePermissionDenied
+	CodeUnauthenticated
+	CodeUnavailable
+	CodeInternal
+	CodeCanceled
+)
+
+var codeNames = map[Code]string{
+	CodeOK:                "ok",
+	CodeUnknown:           "unknown",
+	CodeInvalidArgument:   "invalid argument",
+	CodeNotFound:          "not found",
+	CodeDeadlineExceeded:  "deadline exceeded",
+	CodeResourceExhausted: "resource exhausted",
+	CodePermissionDenied:  "permission denied",
+	CodeUnauthenticated:   "unauthenticated",
+	CodeUnavailable:       "unavailable",
+	CodeInternal:          "internal",
+	CodeCanceled:          "canceled",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return "unknown"
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"github.com/felixorbit/fexrpc/option"
 	"log"
 	"net"
@@ -46,18 +44,22 @@ func callSimple(addr chan string) {
 		_ = conn.Close()
 	}()
 	time.Sleep(time.Second)
-	_ = json.NewEncoder(conn).Encode(option.DefaultOption)
+	// 发送前导字节和 Option，等待服务端接受
+	if _, err := option.Negotiate(conn, option.DefaultOption); err != nil {
+		log.Println("handshake error: ", err)
+		return
+	}
 	cc := codec.NewGobCodec(conn)
 	for i := 0; i < 5; i++ {
 		h := &codec.Header{
-			ServiceMethod: "Foo.Sum",
+			ServiceMethod: "FooSvc.Sum",
 			Seq:           uint64(i),
 		}
-		_ = cc.Write(h, fmt.Sprintf("fexrpc req %d", h.Seq))
+		_ = cc.Write(h, &FooArgs{Num1: i, Num2: i * i})
 		_ = cc.ReadHeader(h)
-		var reply string
+		var reply int
 		_ = cc.ReadBody(&reply)
-		log.Println("reply :", reply)
+		log.Println("reply :", reply, h.Error)
 	}
 }
 
@@ -77,7 +79,8 @@ func call(addr chan string) {
 		go func(i int) {
 			defer wg.Done()
 			args := &FooArgs{Num1: i, Num2: i * i}
-			ctx, _ := context.WithTimeout(context.Background(), time.Second)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
 			var reply int
 			if err := c.Call(ctx, "FooSvc.Sum", args, &reply); err != nil {
 				log.Fatal("call foo.Sum failed: ", err)
@@ -0,0 +1,230 @@
+// Package dispatch 通过反射注册服务方法并执行调用，服务端处理请求和客户端处理反向调用共用
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"github.com/felixorbit/fexrpc/logger"
+)
+
+// Method 符合调用签名的方法或函数
+type Method struct {
+	fn          reflect.Value // 方法或函数
+	recv        bool          // fn 的第一个参数是否为服务实例（结构体方法）
+	ArgType     reflect.Type
+	ReplyType   reflect.Type
+	WithContext bool // 方法第一个参数为 context.Context
+	numCalls    uint64
+	numPanics   uint64
+}
+
+func (m *Method) NumCalls() uint64 {
+	return atomic.LoadUint64(&m.numCalls)
+}
+
+func (m *Method) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numPanics)
+}
+
+func (m *Method) NewArgv() reflect.Value {
+	var argv reflect.Value
+	if m.ArgType.Kind() == reflect.Ptr {
+		argv = reflect.New(m.ArgType.Elem())
+	} else {
+		argv = reflect.New(m.ArgType).Elem()
+	}
+	return argv
+}
+
+func (m *Method) NewReplyv() reflect.Value {
+	replyv := reflect.New(m.ReplyType.Elem())
+	switch m.ReplyType.Elem().Kind() {
+	case reflect.Map:
+		replyv.Elem().Set(reflect.MakeMap(m.ReplyType.Elem()))
+	case reflect.Slice:
+		replyv.Elem().Set(reflect.MakeSlice(m.ReplyType.Elem(), 0, 0))
+	}
+	return replyv
+}
+
+// Body 返回解码参数使用的指针
+func Body(argv reflect.Value) interface{} {
+	if argv.Type().Kind() != reflect.Ptr {
+		return argv.Addr().Interface()
+	}
+	return argv.Interface()
+}
+
+// Service 一个服务及其方法，注册后不再修改，并发读取时无需加锁
+type Service struct {
+	Name   string
+	val    reflect.Value // 结构体实例，函数服务为空
+	Method map[string]*Method
+}
+
+// NewService 创建服务实例，name 为空时使用类型名作为服务名
+func NewService(obj interface{}, name string) (*Service, error) {
+	if obj == nil {
+		return nil, errors.New("rpc: can't register nil service")
+	}
+	s := &Service{val: reflect.ValueOf(obj)}
+	if name == "" {
+		name = reflect.Indirect(s.val).Type().Name()
+		if !ast.IsExported(name) {
+			return nil, fmt.Errorf("rpc: type %s is not exported", name)
+		}
+	}
+	if err := ValidServiceName(name); err != nil {
+		return nil, err
+	}
+	s.Name = name
+	s.registerMethods()
+	if len(s.Method) == 0 {
+		return nil, fmt.Errorf("rpc: service %s has no exported methods of suitable type", s.Name)
+	}
+	return s, nil
+}
+
+// ValidServiceName 服务名格式：Name 或 Name@version，不能包含 "."
+func ValidServiceName(name string) error {
+	base, version, versioned := strings.Cut(name, "@")
+	if base == "" || strings.ContainsAny(name, ". \t") || (versioned && (version == "" || strings.Contains(version, "@"))) {
+		return fmt.Errorf("rpc: %q is not a valid service name, expect Name or Name@version", name)
+	}
+	return nil
+}
+
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// 根据签名创建 Method，不符合要求时返回错误。recv 表示 fn 的第一个参数为接收者
+// 支持两种签名：Method(args, reply) error 和 Method(ctx, args, reply) error
+func newMethod(fn reflect.Value, recv bool) (*Method, error) {
+	fnType := fn.Type()
+	skip := 0
+	if recv {
+		skip = 1
+	}
+	numIn := fnType.NumIn() - skip
+	withContext := numIn == 3 && fnType.In(skip) == typeOfContext
+	if (numIn != 2 && !withContext) || fnType.NumOut() != 1 {
+		return nil, fmt.Errorf("expect (args, reply) or (ctx, args, reply) as arguments and one return value, but got %s", fnType)
+	}
+	if fnType.Out(0) != typeOfError {
+		return nil, fmt.Errorf("return type %s is not error", fnType.Out(0))
+	}
+	argType, replyType := fnType.In(fnType.NumIn()-2), fnType.In(fnType.NumIn()-1)
+	if !isExportedOrBuildInType(argType) || !isExportedOrBuildInType(replyType) {
+		return nil, fmt.Errorf("argument type %s or reply type %s is not exported", argType, replyType)
+	}
+	if replyType.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("reply type %s is not a pointer", replyType)
+	}
+	return &Method{
+		fn:          fn,
+		recv:        recv,
+		ArgType:     argType,
+		ReplyType:   replyType,
+		WithContext: withContext,
+	}, nil
+}
+
+func (s *Service) registerMethods() {
+	s.Method = make(map[string]*Method)
+	typ := s.val.Type()
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		mType, err := newMethod(method.Func, true)
+		if err != nil {
+			continue
+		}
+		s.Method[method.Name] = mType
+		logger.Info("rpc: register", "method", s.Name+"."+method.Name)
+	}
+}
+
+// NewFuncService 基于已有的函数服务（可以为 nil）创建一个新的函数服务，并加入 fn 作为 methodName 方法。
+// 已有的服务不会被修改
+func NewFuncService(old *Service, name, methodName string, fn interface{}) (*Service, error) {
+	if err := ValidServiceName(name); err != nil {
+		return nil, err
+	}
+	if !ast.IsExported(methodName) {
+		return nil, fmt.Errorf("rpc: %q is not a valid method name", methodName)
+	}
+	fnVal := reflect.ValueOf(fn)
+	if fnVal.Kind() != reflect.Func {
+		return nil, fmt.Errorf("rpc: %s.%s is not a function", name, methodName)
+	}
+	mType, err := newMethod(fnVal, false)
+	if err != nil {
+		return nil, fmt.Errorf("rpc: invalid function %s.%s: %v", name, methodName, err)
+	}
+	s := &Service{Name: name, Method: make(map[string]*Method)}
+	if old != nil {
+		if old.val.IsValid() {
+			return nil, errors.New("rpc: service already registered: " + name)
+		}
+		if _, dup := old.Method[methodName]; dup {
+			return nil, fmt.Errorf("rpc: method already registered: %s.%s", name, methodName)
+		}
+		for n, m := range old.Method {
+			s.Method[n] = m
+		}
+	}
+	s.Method[methodName] = mType
+	logger.Info("rpc: register", "method", name+"."+methodName)
+	return s, nil
+}
+
+func isExportedOrBuildInType(t reflect.Type) bool {
+	return ast.IsExported(t.Name()) || t.PkgPath() == ""
+}
+
+// PanicError 方法执行时发生 panic，保存 panic 的值和调用栈
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Call 调用方法，ctx 仅传递给第一个参数为 context.Context 的方法。方法 panic 时返回 *PanicError
+func (s *Service) Call(ctx context.Context, m *Method, argv, replyv reflect.Value) (err error) {
+	atomic.AddUint64(&m.numCalls, 1)
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&m.numPanics, 1)
+			err = &PanicError{Value: r, Stack: stack()}
+		}
+	}()
+	in := make([]reflect.Value, 0, 4)
+	if m.recv {
+		in = append(in, s.val)
+	}
+	if m.WithContext {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	returnValues := m.fn.Call(append(in, argv, replyv))
+	if errInter := returnValues[0].Interface(); errInter != nil {
+		return errInter.(error)
+	}
+	return nil
+}
+
+// 获取当前协程的调用栈
+func stack() []byte {
+	buf := make([]byte, 64<<10)
+	return buf[:runtime.Stack(buf, false)]
+}
@@ -0,0 +1,54 @@
+// Package logger 框架各个包输出日志使用的接口，默认使用 slog.Default()，可以通过 SetLogger 替换
+package logger
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// Logger 结构化日志接口，args 为交替出现的 key/value，*slog.Logger 实现了该接口
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type holder struct {
+	Logger
+}
+
+var current atomic.Pointer[holder]
+
+// SetLogger 设置所有包使用的日志接口，nil 表示恢复使用 slog.Default()
+func SetLogger(l Logger) {
+	if l == nil {
+		current.Store(nil)
+		return
+	}
+	current.Store(&holder{Logger: l})
+}
+
+// Default 返回当前使用的日志接口
+func Default() Logger {
+	if h := current.Load(); h != nil {
+		return h.Logger
+	}
+	return slog.Default()
+}
+
+func Debug(msg string, args ...interface{}) {
+	Default().Debug(msg, args...)
+}
+
+func Info(msg string, args ...interface{}) {
+	Default().Info(msg, args...)
+}
+
+func Warn(msg string, args ...interface{}) {
+	Default().Warn(msg, args...)
+}
+
+func Error(msg string, args ...interface{}) {
+	Default().Error(msg, args...)
+}
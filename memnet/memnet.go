@@ -0,0 +1,140 @@
+// Package memnet 提供进程内的内存连接，不依赖 socket，用于测试以及同一进程内的服务调用。
+// 监听器通过名称区分，客户端使用 "mem@name" 地址连接
+package memnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Network 内存连接的网络类型
+const Network = "mem"
+
+var (
+	ErrListenerClosed = errors.New("memnet: listener closed")
+	ErrAddrInUse      = errors.New("memnet: address already in use")
+	ErrConnRefused    = errors.New("memnet: connection refused")
+)
+
+type addr string
+
+func (a addr) Network() string { return Network }
+func (a addr) String() string  { return string(a) }
+
+var (
+	mu        sync.Mutex
+	listeners = make(map[string]*Listener)
+)
+
+// Listener 内存监听器，实现 net.Listener
+type Listener struct {
+	name  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+// Listen 创建名为 name 的内存监听器，同名监听器关闭前不能重复创建
+func Listen(name string) (*Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := listeners[name]; ok {
+		return nil, ErrAddrInUse
+	}
+	l := &Listener{name: name, conns: make(chan net.Conn), done: make(chan struct{})}
+	listeners[name] = l
+	return l, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		mu.Lock()
+		delete(listeners, l.name)
+		mu.Unlock()
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return addr(l.name)
+}
+
+// 内存连接，替换 net.Pipe 的地址信息
+type conn struct {
+	net.Conn
+	local, remote addr
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+// Dial 连接名为 name 的内存监听器
+func Dial(name string) (net.Conn, error) {
+	return DialContext(context.Background(), name)
+}
+
+// DialTimeout 连接名为 name 的内存监听器，timeout 为 0 表示不限制
+func DialTimeout(name string, timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return DialContext(ctx, name)
+}
+
+// DialContext 连接名为 name 的内存监听器，等待对方 Accept
+func DialContext(ctx context.Context, name string) (net.Conn, error) {
+	mu.Lock()
+	l, ok := listeners[name]
+	mu.Unlock()
+	if !ok {
+		return nil, ErrConnRefused
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &conn{Conn: server, local: addr(name), remote: addr(name + "-client")}:
+		return &conn{Conn: client, local: addr(name + "-client"), remote: addr(name)}, nil
+	case <-l.done:
+	case <-ctx.Done():
+		_ = client.Close()
+		_ = server.Close()
+		return nil, ctx.Err()
+	}
+	_ = client.Close()
+	_ = server.Close()
+	return nil, ErrConnRefused
+}
+
+// HTTPClient 返回通过内存连接发送请求的 HTTP 客户端，URL 中的 host 为监听器名称，
+// 例如 http://registry/_fexrpc_/registry 会连接名为 registry 的监听器
+func HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					host = address
+				}
+				return DialContext(ctx, host)
+			},
+		},
+	}
+}
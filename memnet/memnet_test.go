@@ -0,0 +1,45 @@
+package memnet
+
+import (
+	"fmt"
+	"io"
+	"testing"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed:"+msg, v...))
+	}
+}
+
+func TestListenAndDial(t *testing.T) {
+	l, err := Listen("memnet-test")
+	_assert(err == nil, "listen failed: %v", err)
+	_, err = Listen("memnet-test")
+	_assert(err == ErrAddrInUse, "expect address in use, but got %v", err)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn, err := Dial("memnet-test")
+	_assert(err == nil, "dial failed: %v", err)
+	_assert(conn.RemoteAddr().Network() == Network && conn.RemoteAddr().String() == "memnet-test", "unexpected remote addr %v", conn.RemoteAddr())
+	_, _ = conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	_assert(err == nil && string(buf) == "ping", "expect echo, but got %q, %v", buf, err)
+	_ = conn.Close()
+
+	_ = l.Close()
+	_, err = l.Accept()
+	_assert(err == ErrListenerClosed, "expect listener closed, but got %v", err)
+	_, err = Dial("memnet-test")
+	_assert(err == ErrConnRefused, "expect connection refused, but got %v", err)
+	l2, err := Listen("memnet-test")
+	_assert(err == nil, "name should be reusable after close, but got %v", err)
+	_ = l2.Close()
+}
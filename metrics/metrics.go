@@ -0,0 +1,291 @@
+// Package metrics 以 Prometheus 文本格式导出计数器、仪表和直方图，
+// 服务端在 common.DefaultMetricsPath 提供，客户端和 XClient 的指标记录在 Default 中
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets 默认的直方图桶上界，单位为秒
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default 进程内客户端和 XClient 使用的指标集合
+var Default = NewRegistry()
+
+// Registry 一组指标，按注册顺序输出
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	names    map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]*family)}
+}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+// family 同名指标，按标签值区分序列
+type family struct {
+	name, help string
+	kind       kind
+	labels     []string
+	buckets    []float64
+	fn         func() float64 // 导出时计算的指标，没有标签
+	mu         sync.Mutex
+	series     map[string]*series
+}
+
+type series struct {
+	labels string // 格式化后的标签，例如 method="Foo.Sum"
+	value  atomicFloat
+	counts []atomic.Uint64 // 直方图各个桶的计数，不累加
+	count  atomic.Uint64
+}
+
+// atomicFloat 可以原子更新的 float64
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) Add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Set(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+// 注册指标，同名指标已存在时返回已有的指标，类型或标签不同时 panic
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.names[f.name]; ok {
+		if old.kind != f.kind || strings.Join(old.labels, ",") != strings.Join(f.labels, ",") {
+			panic("metrics: " + f.name + " registered with different type or labels")
+		}
+		return old
+	}
+	f.series = make(map[string]*series)
+	r.names[f.name] = f
+	r.families = append(r.families, f)
+	return f
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	var b strings.Builder
+	for i, name := range f.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	key := b.String()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key}
+		if f.kind == kindHistogram {
+			s.counts = make([]atomic.Uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// CounterVec 按标签区分的计数器
+type CounterVec struct{ f *family }
+
+// Counter 只增不减的计数
+type Counter struct{ s *series }
+
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: r.register(&family{name: name, help: help, kind: kindCounter, labels: labels})}
+}
+
+// With 获取标签值对应的计数器，values 与注册时的标签一一对应
+func (v *CounterVec) With(values ...string) Counter {
+	return Counter{s: v.f.with(values)}
+}
+
+func (c Counter) Inc() {
+	c.s.value.Add(1)
+}
+
+// Add 增加计数，v 不能为负数
+func (c Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.s.value.Add(v)
+}
+
+// GaugeVec 按标签区分的仪表
+type GaugeVec struct{ f *family }
+
+// Gauge 可增可减的当前值
+type Gauge struct{ s *series }
+
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(&family{name: name, help: help, kind: kindGauge, labels: labels})}
+}
+
+func (v *GaugeVec) With(values ...string) Gauge {
+	return Gauge{s: v.f.with(values)}
+}
+
+func (g Gauge) Inc()          { g.s.value.Add(1) }
+func (g Gauge) Dec()          { g.s.value.Add(-1) }
+func (g Gauge) Add(v float64) { g.s.value.Add(v) }
+func (g Gauge) Set(v float64) { g.s.value.Set(v) }
+
+// CounterFunc 注册导出时通过 fn 获取值的计数器，用于已经在别处统计的数据
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: kindCounter, fn: fn})
+}
+
+// GaugeFunc 注册导出时通过 fn 获取值的仪表
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: kindGauge, fn: fn})
+}
+
+// HistogramVec 按标签区分的直方图
+type HistogramVec struct{ f *family }
+
+// Histogram 统计观测值的分布
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Histogram 注册直方图，buckets 为递增的桶上界，为空时使用 DefBuckets
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets must be sorted: " + name)
+	}
+	return &HistogramVec{f: r.register(&family{name: name, help: help, kind: kindHistogram, labels: labels, buckets: buckets})}
+}
+
+func (v *HistogramVec) With(values ...string) Histogram {
+	return Histogram{s: v.f.with(values), buckets: v.f.buckets}
+}
+
+func (h Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.s.counts[i].Add(1)
+	}
+	h.s.count.Add(1)
+	h.s.value.Add(v)
+}
+
+// WriteText 以 Prometheus 文本格式输出所有指标，同一指标的序列按标签排序
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *family) write(b *strings.Builder) {
+	f.mu.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.Unlock()
+	if f.fn == nil && len(all) == 0 {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].labels < all[j].labels })
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	if f.fn != nil {
+		fmt.Fprintf(b, "%s %s\n", f.name, formatFloat(f.fn()))
+		return
+	}
+	for _, s := range all {
+		if f.kind != kindHistogram {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, braces(s.labels), formatFloat(s.value.Load()))
+			continue
+		}
+		sep := ""
+		if s.labels != "" {
+			sep = ","
+		}
+		var cumulative uint64
+		for i, le := range f.buckets {
+			cumulative += s.counts[i].Load()
+			fmt.Fprintf(b, "%s_bucket{%s%sle=\"%s\"} %d\n", f.name, s.labels, sep, formatFloat(le), cumulative)
+		}
+		count := s.count.Load()
+		fmt.Fprintf(b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", f.name, s.labels, sep, count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, braces(s.labels), formatFloat(s.value.Load()))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, braces(s.labels), count)
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler 依次输出 registries 中的指标
+func Handler(registries ...*Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, r := range registries {
+			if err := r.WriteText(w); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed:"+msg, v...))
+	}
+}
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := NewRegistry()
+	calls := r.Counter("calls_total", "Calls.", "method")
+	calls.With("Foo.Sum").Inc()
+	calls.With("Foo.Sum").Add(2)
+	calls.With(`a"b`).Inc()
+	r.Gauge("in_flight", "In flight.", "method").With("Foo.Sum").Dec()
+	r.GaugeFunc("conns", "Conns.", func() float64 { return 3 })
+	latency := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}).With()
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(2)
+	r.Counter("unused_total", "Never used.", "method")
+
+	var b strings.Builder
+	_ = r.WriteText(&b)
+	want := `# HELP calls_total Calls.
+# TYPE calls_total counter
+calls_total{method="Foo.Sum"} 3
+calls_total{method="a\"b"} 1
+# HELP in_flight In flight.
+# TYPE in_flight gauge
+in_flight{method="Foo.Sum"} -1
+# HELP conns Conns.
+# TYPE conns gauge
+conns 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+`
+	_assert(b.String() == want, "unexpected output:\n%s", b.String())
+}
+
+func TestRegistry_registerTwice(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("calls_total", "Calls.", "method").With("a").Inc()
+	r.Counter("calls_total", "Calls.", "method").With("a").Inc()
+	var b strings.Builder
+	_ = r.WriteText(&b)
+	_assert(strings.Contains(b.String(), `calls_total{method="a"} 2`), "same metric should be shared, got:\n%s", b.String())
+	defer func() {
+		_assert(recover() != nil, "expect panic on conflicting registration")
+	}()
+	r.Gauge("calls_total", "Calls.", "method")
+}
@@ -0,0 +1,50 @@
+package option
+
+import "strings"
+
+// Capability 建立连接时协商的协议能力，按位组合
+type Capability uint64
+
+const (
+	CapCompression  Capability = 1 << iota // 消息压缩
+	CapStreaming                           // 流式调用
+	CapMetadata                            // 通过 Header.Meta 传递扩展元数据
+	CapCancellation                        // 客户端放弃调用时通知服务端取消
+	CapKeepalive                           // 客户端定期发送心跳
+	CapReverse                             // 客户端能够识别 Header.Reverse，接受服务端发起的反向调用
+	CapIdempotency                         // 服务端按幂等键对调用去重
+)
+
+// DefaultCapabilities 当前实现支持的能力，压缩和流式调用尚未支持，不会出现在协商结果中
+const DefaultCapabilities = CapMetadata | CapCancellation | CapKeepalive | CapReverse | CapIdempotency
+
+var capabilityNames = []struct {
+	c    Capability
+	name string
+}{
+	{CapCompression, "compression"},
+	{CapStreaming, "streaming"},
+	{CapMetadata, "metadata"},
+	{CapCancellation, "cancellation"},
+	{CapKeepalive, "keepalive"},
+	{CapReverse, "reverse"},
+	{CapIdempotency, "idempotency"},
+}
+
+// Has 是否包含 flag 中的所有能力
+func (c Capability) Has(flag Capability) bool {
+	return c&flag == flag
+}
+
+func (c Capability) String() string {
+	var names []string
+	for _, cn := range capabilityNames {
+		if c.Has(cn.c) {
+			names = append(names, cn.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
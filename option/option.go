@@ -1,10 +1,20 @@
 package option
 
 import (
-	"github.com/felixorbit/fexrpc/common"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"syscall"
 	"time"
 
+	"github.com/felixorbit/fexrpc/auth"
 	"github.com/felixorbit/fexrpc/codec"
+	"github.com/felixorbit/fexrpc/common"
 )
 
 type Option struct {
@@ -12,9 +22,295 @@ type Option struct {
 	CodecType      codec.CType   `json:"codec_type"`
 	ConnectTimeout time.Duration `json:"connect_timeout"` // 连接超时控制。0 代表没有限制
 	HandleTimeout  time.Duration `json:"handle_timeout"`
+	// Capabilities 客户端请求的协议能力，服务端回复双方都支持的子集。客户端为 0 时使用 DefaultCapabilities
+	Capabilities Capability `json:"capabilities,omitempty"`
+
+	// ProtocolVersion 使用的协议版本，在前导字节中发送，0 表示最新版本，ProtocolLegacy 表示不发送前导字节。
+	// 服务端不支持时客户端自动降级到版本 1；连接引入前导字节之前的服务端需要显式指定 ProtocolLegacy
+	ProtocolVersion int `json:"-"`
+	// KeepAlive 客户端发送心跳的间隔，服务端支持 CapKeepalive 时生效，0 表示不发送。仅在本地使用
+	KeepAlive time.Duration `json:"-"`
+	// CacheSize 客户端缓存服务端标记为可缓存的结果，最多保存的条目数，0 表示不缓存。仅在本地使用
+	CacheSize int `json:"-"`
+
+	// TLSConfig 客户端使用 tls/https 协议连接时的配置，为 nil 时使用默认配置。仅在本地使用，不会发送给服务端
+	TLSConfig *tls.Config `json:"-"`
+	// Credentials 客户端凭证，服务端开启认证时在 Option 协商后发送。仅在本地使用，不会随 Option 发送
+	Credentials auth.Credentials `json:"-"`
+}
+
+// 二进制编码时使用的定长结构
+type binaryOption struct {
+	MagicNumber    uint64
+	CodecType      codec.CType
+	ConnectTimeout time.Duration
+	HandleTimeout  time.Duration
+}
+
+// 协议版本 2 在二进制 Option 之后追加的字段
+type binaryOptionV2 struct {
+	Capabilities Capability
+}
+
+// ProtocolVersion 当前的协议版本。客户端先发送一个前导字节，高 4 位为协议版本，低 4 位为 Option 的编码方式，
+// 服务端据此识别每个连接的编码方式，并回复接受或拒绝。
+// 1：Option 只包含基本字段；2：Option 中增加能力集，服务端在回复中返回协商后的能力
+const ProtocolVersion = 2
+
+// ProtocolLegacy 不发送前导字节、不等待回复的握手，用于连接引入前导字节之前的服务端。
+// 这类服务端拒绝时直接关闭连接，客户端在第一次调用时才能发现
+const ProtocolLegacy = -1
+
+var (
+	// ErrRejected 服务端拒绝了 Option 协商
+	ErrRejected = errors.New("rpc: connection rejected")
+	// ErrUnsupportedVersion 服务端不支持客户端使用的协议版本
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	// ErrNoReply 服务端没有回复就关闭了连接，可能是不识别前导字节的旧版本服务端，可以使用 ProtocolLegacy 连接
+	ErrNoReply = errors.New("rpc: connection closed during handshake")
+)
+
+// Handshake 握手的协商结果
+type Handshake struct {
+	Version      int        // 协议版本，0 表示没有前导字节的旧版本客户端，不需要回复
+	Format       int        // Option 的编码方式，common.OptionCodec*
+	Capabilities Capability // 服务端读取时为客户端请求的能力，回复时为双方都支持的能力
 }
 
-// OptCodecType Option 的编码方式
+// JSON 编码的 Option 及回复以换行结尾，超过该长度视为非法
+const maxJSONLine = 4096
+
+// Write 写入前导字节，并按照 OptCodecType 编码 Option。使用 opt.ProtocolVersion 指定的协议版本，
+// 版本 1 和 ProtocolLegacy 不发送能力集，ProtocolLegacy 不发送前导字节
+func Write(w io.Writer, opt *Option) error {
+	format, version := OptCodecType, opt.protocolVersion()
+	if format != common.OptionCodecBinary && format != common.OptionCodecJson {
+		return fmt.Errorf("invalid option codec type: %v", format)
+	}
+	if (version < 1 && version != ProtocolLegacy) || version > ProtocolVersion {
+		return fmt.Errorf("invalid protocol version: %v", version)
+	}
+	if version != ProtocolLegacy {
+		if _, err := w.Write([]byte{byte(version<<4 | format)}); err != nil {
+			return err
+		}
+	}
+	wire := *opt
+	if version < 2 {
+		wire.Capabilities = 0
+	}
+	if format == common.OptionCodecJson {
+		return writeJSONLine(w, &wire)
+	}
+	if err := binary.Write(w, binary.BigEndian, &binaryOption{
+		MagicNumber:    wire.MagicNumber,
+		CodecType:      wire.CodecType,
+		ConnectTimeout: wire.ConnectTimeout,
+		HandleTimeout:  wire.HandleTimeout,
+	}); err != nil {
+		return err
+	}
+	if version < 2 {
+		return nil
+	}
+	return binary.Write(w, binary.BigEndian, &binaryOptionV2{Capabilities: wire.Capabilities})
+}
+
+// Read 根据前导字节识别协议版本和编码方式并读取 Option。读写连接出错时 Handshake 为 nil，
+// 否则即使返回错误也会返回 Handshake，用于回复拒绝原因
+func Read(r io.Reader, opt *Option) (*Handshake, error) {
+	var lead [1]byte
+	if _, err := io.ReadFull(r, lead[:]); err != nil {
+		return nil, err
+	}
+	hs := &Handshake{Version: int(lead[0] >> 4), Format: int(lead[0] & 0x0f)}
+	switch lead[0] {
+	case 0: // 旧版本的二进制 Option，MagicNumber 的最高字节为 0
+		hs = &Handshake{Format: common.OptionCodecBinary}
+		r = io.MultiReader(bytes.NewReader(lead[:]), r)
+	case '{': // 旧版本的 JSON Option
+		hs = &Handshake{Format: common.OptionCodecJson}
+		r = io.MultiReader(bytes.NewReader(lead[:]), r)
+	default:
+		if hs.Version < 1 || hs.Version > ProtocolVersion {
+			return hs, fmt.Errorf("unsupported handshake version: %d", hs.Version)
+		}
+	}
+	switch hs.Format {
+	case common.OptionCodecBinary:
+		var bo binaryOption
+		if err := binary.Read(r, binary.BigEndian, &bo); err != nil {
+			return nil, err
+		}
+		*opt = Option{
+			MagicNumber:    bo.MagicNumber,
+			CodecType:      bo.CodecType,
+			ConnectTimeout: bo.ConnectTimeout,
+			HandleTimeout:  bo.HandleTimeout,
+		}
+		if hs.Version >= 2 {
+			var v2 binaryOptionV2
+			if err := binary.Read(r, binary.BigEndian, &v2); err != nil {
+				return nil, err
+			}
+			opt.Capabilities = v2.Capabilities
+		}
+	case common.OptionCodecJson:
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(line, opt); err != nil {
+			return hs, err
+		}
+		if hs.Version < 2 {
+			opt.Capabilities = 0
+		}
+	default:
+		return hs, fmt.Errorf("invalid option codec type: %v", hs.Format)
+	}
+	opt.ProtocolVersion = hs.Version
+	hs.Capabilities = opt.Capabilities
+	return hs, nil
+}
+
+// 协商结果，JSON 编码时使用
+type reply struct {
+	Accepted     bool       `json:"accepted"`
+	Reason       string     `json:"reason,omitempty"`
+	Capabilities Capability `json:"capabilities,omitempty"`
+	Version      int        `json:"version,omitempty"` // 服务端支持的最高协议版本，版本 1 的服务端不回复
+}
+
+// WriteReply 服务端回复协商结果，reason 为空表示接受。使用客户端的编码方式，
+// 无法识别时使用二进制：1 字节状态 + 2 字节长度 + 拒绝原因，协议版本 2 接受时再追加 8 字节的 hs.Capabilities。
+// 状态的低 4 位 0 表示接受、1 表示拒绝；协议版本 2 起高 4 位为服务端支持的最高协议版本
+func WriteReply(w io.Writer, hs *Handshake, reason string) error {
+	if hs.Version == 0 {
+		return nil
+	}
+	var caps Capability
+	var version int
+	if hs.Version >= 2 {
+		version = ProtocolVersion
+		if reason == "" {
+			caps = hs.Capabilities
+		}
+	}
+	if hs.Format == common.OptionCodecJson {
+		return writeJSONLine(w, &reply{Accepted: reason == "", Reason: reason, Capabilities: caps, Version: version})
+	}
+	if len(reason) > math.MaxUint16 {
+		reason = reason[:math.MaxUint16]
+	}
+	buf := make([]byte, 3, 3+len(reason)+8)
+	buf[0] = byte(version << 4)
+	if reason != "" {
+		buf[0] |= 1
+	}
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(reason)))
+	buf = append(buf, reason...)
+	if reason == "" && hs.Version >= 2 {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(caps))
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadReply 客户端读取协商结果，hs 为发送的版本和编码方式，读取后设置为协商后的能力。
+// 被拒绝时返回 ErrRejected，回复中服务端支持的最高版本低于 hs.Version 时同时返回 ErrUnsupportedVersion。
+// 版本 1 的服务端不回复支持的版本，但只会因为版本不支持拒绝更高版本的客户端
+func ReadReply(r io.Reader, hs *Handshake) error {
+	var rep reply
+	if hs.Format == common.OptionCodecJson {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(line, &rep); err != nil {
+			return err
+		}
+	} else {
+		var head [3]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return err
+		}
+		reason := make([]byte, binary.BigEndian.Uint16(head[1:]))
+		if _, err := io.ReadFull(r, reason); err != nil {
+			return err
+		}
+		rep = reply{Accepted: head[0]&0x0f == 0, Reason: string(reason)}
+		if hs.Version >= 2 {
+			rep.Version = int(head[0] >> 4)
+		}
+		if rep.Accepted && hs.Version >= 2 {
+			if err := binary.Read(r, binary.BigEndian, &rep.Capabilities); err != nil {
+				return err
+			}
+		}
+	}
+	if !rep.Accepted {
+		if hs.Version >= 2 && rep.Version < hs.Version {
+			return fmt.Errorf("%w: %w: %s", ErrRejected, ErrUnsupportedVersion, rep.Reason)
+		}
+		return fmt.Errorf("%w: %s", ErrRejected, rep.Reason)
+	}
+	hs.Capabilities = rep.Capabilities
+	return nil
+}
+
+// Negotiate 客户端发送 Option 并等待服务端接受，返回协商结果。ProtocolLegacy 不等待回复，没有协商的能力。
+// 服务端没有回复就关闭连接时返回 ErrNoReply
+func Negotiate(rw io.ReadWriter, opt *Option) (*Handshake, error) {
+	if err := Write(rw, opt); err != nil {
+		return nil, err
+	}
+	if opt.protocolVersion() == ProtocolLegacy {
+		return &Handshake{Format: OptCodecType}, nil
+	}
+	hs := &Handshake{Version: opt.protocolVersion(), Format: OptCodecType}
+	if err := ReadReply(rw, hs); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+			return nil, fmt.Errorf("%w: %w", ErrNoReply, err)
+		}
+		return nil, err
+	}
+	return hs, nil
+}
+
+func (opt *Option) protocolVersion() int {
+	if opt.ProtocolVersion == 0 {
+		return ProtocolVersion
+	}
+	return opt.ProtocolVersion
+}
+
+func writeJSONLine(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// 逐字节读取一行，避免读走握手之后的数据
+func readLine(r io.Reader) ([]byte, error) {
+	var line []byte
+	var b [1]byte
+	for len(line) < maxJSONLine {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		line = append(line, b[0])
+	}
+	return nil, errors.New("option line too long")
+}
+
+// OptCodecType 客户端发送 Option 使用的编码方式，服务端根据前导字节自动识别
 var OptCodecType = common.OptionCodecBinary
 
 const (
@@ -25,4 +321,15 @@ var DefaultOption = &Option{
 	MagicNumber:    MagicNumber,
 	CodecType:      codec.GobType,
 	ConnectTimeout: 10 * time.Second,
+	Capabilities:   DefaultCapabilities,
+}
+
+// MethodOption 服务端注册服务时为方法指定的配置，可以传入多个：先应用 Method 为空的服务级配置，
+// 再应用指定方法的配置，同一级别按传入顺序应用。为 0 的字段不修改之前的配置，
+// 因此方法级配置只需要指定与服务级配置不同的字段
+type MethodOption struct {
+	Method     string        // 方法名，为空时作用于服务的所有方法
+	Timeout    time.Duration // 客户端未指定 HandleTimeout 时使用的处理超时
+	MaxTimeout time.Duration // 允许的最大处理超时，客户端指定的值会被限制在该值以内
+	CacheTTL   time.Duration // 成功结果按方法和参数缓存的时间，适用于没有副作用的查询方法，0 表示不缓存。接收 context 的方法不支持缓存，服务级配置会跳过这些方法
 }
@@ -1,12 +1,16 @@
 package registry
 
 import (
-	"log"
+	"context"
+	"net"
 	"net/http"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/logger"
 )
 
 type ServerItem struct {
@@ -73,6 +77,11 @@ func (r *FexRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		// 服务列表以 "," 分隔返回，地址中不能包含 ","
+		if _, _, err := common.ParseRPCAddr(addr); err != nil || strings.Contains(addr, ",") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		r.putServer(addr)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -81,37 +90,56 @@ func (r *FexRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 func (r *FexRegistry) HandleHTTP(registryPath string) {
 	http.Handle(registryPath, r)
-	log.Println("rpc registry path: ", registryPath)
+	logger.Info("rpc registry: path", "path", registryPath)
 }
 
 func HandleHTTP() {
 	DefaultRegistry.HandleHTTP(defaultPath)
 }
 
-func sendHeartbeat(registry, addr string) error {
-	log.Println(addr, " send heart beat to registry ", registry)
-	httpClient := &http.Client{}
+func sendHeartbeat(httpClient *http.Client, registry, addr string) error {
+	logger.Debug("rpc registry: send heart beat", "addr", addr, "registry", registry)
 	req, _ := http.NewRequest("POST", registry, nil)
 	req.Header.Set("X-Fexrpc-Server", addr)
-	if _, err := httpClient.Do(req); err != nil {
-		log.Println("rpc server: heart beat err: ", err)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logger.Warn("rpc server: heart beat error", "registry", registry, "err", err)
 		return err
 	}
+	_ = resp.Body.Close()
 	return nil
 }
 
 // Heartbeat 用于服务定时向注册中心发送心跳. addr: protocol@addr
 func Heartbeat(registry, addr string, duration time.Duration) {
+	HeartbeatWithClient(&http.Client{}, registry, addr, duration)
+}
+
+// HeartbeatWithClient 使用指定的 HTTP 客户端发送心跳，例如通过 memnet.HTTPClient 访问内存中的注册中心
+func HeartbeatWithClient(httpClient *http.Client, registry, addr string, duration time.Duration) {
 	if duration == 0 {
 		duration = defaultTimeout - time.Minute
 	}
 	var err error
-	err = sendHeartbeat(registry, addr)
+	err = sendHeartbeat(httpClient, registry, addr)
 	go func() {
 		t := time.NewTicker(duration)
 		for err == nil {
 			<-t.C
-			err = sendHeartbeat(registry, addr)
+			err = sendHeartbeat(httpClient, registry, addr)
 		}
 	}()
 }
+
+// UnixHTTPClient 返回通过 Unix Domain Socket 访问注册中心的 HTTP 客户端，URL 中的 host 会被忽略，
+// 例如 http://unix/_fexrpc_/registry。配合 HeartbeatWithClient 和 FexRegistryDiscovery.SetHTTPClient 使用
+func UnixHTTPClient(socketPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
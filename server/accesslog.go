@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"path"
+	"time"
+
+	"github.com/felixorbit/fexrpc/codec"
+	"github.com/felixorbit/fexrpc/logger"
+)
+
+// AccessLog 访问日志配置。每次调用响应后记录方法、对端、耗时、请求和响应字节数、状态码和请求 ID
+type AccessLog struct {
+	Logger  logger.Logger // 为 nil 时使用 logger.Default()
+	LogArgs bool          // 是否记录参数
+	Redact  []RedactRule  // 记录参数时的脱敏规则
+}
+
+// RedactRule 参数脱敏规则，匹配的字段在日志中替换为 "[REDACTED]"
+type RedactRule struct {
+	Methods []string // 生效的 "Service.Method" 模式，支持 path.Match 通配，为空时作用于所有方法
+	// Fields 参数 JSON 编码后的字段名，"Password" 匹配任意层级的同名字段，"Card.Number" 匹配完整路径
+	Fields []string
+}
+
+const redacted = "[REDACTED]"
+
+// SetAccessLog 设置访问日志，nil 表示不记录
+func (s *Server) SetAccessLog(cfg *AccessLog) {
+	s.accessLogCfg.Store(cfg)
+}
+
+func (s *Server) accessLog(sc *serverConn, req *request, h *codec.Header, respSize int64) {
+	cfg := s.accessLogCfg.Load()
+	if cfg == nil {
+		return
+	}
+	l := cfg.Logger
+	if l == nil {
+		l = logger.Default()
+	}
+	principal, _, _ := peerIdentity(sc.peer)
+	args := []interface{}{
+		"method", h.ServiceMethod,
+		"request_id", req.id,
+		"conn", sc.peer.ID,
+		"remote", sc.peer.RemoteAddr,
+		"principal", principal,
+		"duration", time.Since(req.start),
+		"req_bytes", req.size,
+		"resp_bytes", respSize,
+		"code", h.Code.String(),
+	}
+	if h.Error != "" {
+		args = append(args, "error", h.Error)
+	}
+	if cfg.LogArgs && req.argv.IsValid() {
+		args = append(args, "args", cfg.redact(h.ServiceMethod, req.argv.Interface()))
+	}
+	l.Info("rpc access", args...)
+}
+
+// 按规则脱敏参数，没有需要脱敏的字段时原样返回
+func (cfg *AccessLog) redact(serviceMethod string, argv interface{}) interface{} {
+	fields := make(map[string]bool)
+	for _, rule := range cfg.Redact {
+		if matchMethod(rule.Methods, serviceMethod) {
+			for _, f := range rule.Fields {
+				fields[f] = true
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return argv
+	}
+	data, err := json.Marshal(argv)
+	if err != nil {
+		return redacted
+	}
+	var v interface{}
+	if err = json.Unmarshal(data, &v); err != nil {
+		return redacted
+	}
+	return redactValue(v, "", fields)
+}
+
+func redactValue(v interface{}, prefix string, fields map[string]bool) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, val := range x {
+			p := k
+			if prefix != "" {
+				p = prefix + "." + k
+			}
+			if fields[k] || fields[p] {
+				x[k] = redacted
+				continue
+			}
+			x[k] = redactValue(val, p, fields)
+		}
+	case []interface{}:
+		for i := range x {
+			x[i] = redactValue(x[i], prefix, fields)
+		}
+	}
+	return v
+}
+
+// 方法是否匹配 patterns 中的任意一个，patterns 为空时匹配所有方法
+func matchMethod(patterns []string, serviceMethod string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, serviceMethod); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"path"
+
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/logger"
+)
+
+// ACLRule 访问控制规则：匹配的主体可以调用匹配的方法
+type ACLRule struct {
+	Principals []string // 主体名称，"*" 表示任意已认证的主体
+	Roles      []string // 主体拥有其中任一角色即匹配
+	Anonymous  bool     // 是否匹配未认证的连接
+	Methods    []string // "Service.Method" 模式，支持 path.Match 通配，例如 "Arith.*"、"*.Get*"
+}
+
+// ACL 访问控制列表，设置后默认拒绝，请求匹配任一规则时允许
+type ACL struct {
+	Rules []ACLRule
+}
+
+// SetACL 设置访问控制列表，可以在运行时更新，nil 表示不做限制。
+// 主体来自认证器（Peer.Principal），未开启认证时使用 mTLS 的客户端证书身份
+func (s *Server) SetACL(acl *ACL) {
+	s.acl.Store(acl)
+}
+
+// 获取连接的主体名称和角色
+func peerIdentity(p *Peer) (name string, roles []string, authenticated bool) {
+	switch {
+	case p.Principal != nil:
+		return p.Principal.Name, p.Principal.Roles, true
+	case p.TLSIdentity != "":
+		return p.TLSIdentity, nil, true
+	}
+	return "", nil, false
+}
+
+func (r *ACLRule) matchPeer(name string, roles []string, authenticated bool) bool {
+	if !authenticated {
+		return r.Anonymous
+	}
+	for _, p := range r.Principals {
+		if p == "*" || p == name {
+			return true
+		}
+	}
+	for _, want := range r.Roles {
+		for _, role := range roles {
+			if want == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *ACLRule) matchMethod(serviceMethod string) bool {
+	for _, pattern := range r.Methods {
+		if ok, _ := path.Match(pattern, serviceMethod); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *ACL) allow(p *Peer, serviceMethod string) bool {
+	name, roles, authenticated := peerIdentity(p)
+	for i := range acl.Rules {
+		rule := &acl.Rules[i]
+		if rule.matchPeer(name, roles, authenticated) && rule.matchMethod(serviceMethod) {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查连接是否有权限调用方法，拒绝时记录审计日志
+func (s *Server) authorize(p *Peer, serviceMethod string) error {
+	acl := s.acl.Load()
+	if acl == nil || p == nil || acl.allow(p, serviceMethod) {
+		return nil
+	}
+	name, roles, _ := peerIdentity(p)
+	logger.Warn("rpc server: audit: permission denied",
+		"method", serviceMethod, "principal", name, "roles", roles, "conn", p.ID, "remote", p.RemoteAddr)
+	return &statusError{code: common.CodePermissionDenied, msg: "rpc server: permission denied: " + serviceMethod}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/felixorbit/fexrpc/codec"
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/logger"
+	"github.com/felixorbit/fexrpc/option"
+)
+
+// 连接级超时配置，0 表示不限制
+type connTimeouts struct {
+	handshake time.Duration // 建立连接到完成 Option 协商和认证
+	read      time.Duration // 消息的第一个字节到达后读完整条消息
+	idle      time.Duration // 没有处理中的请求时等待下一条消息
+}
+
+// 连接相关的计数，展示在调试页面
+type connStats struct {
+	rejected          atomic.Uint64 // 超过最大连接数被拒绝
+	handshakeTimeouts atomic.Uint64
+	readTimeouts      atomic.Uint64
+	idleClosed        atomic.Uint64
+}
+
+// SetConnTimeouts 设置握手超时、单条消息读取超时和空闲连接超时，0 表示不限制。
+// 对之后建立的连接生效，连接需要支持 SetDeadline（net.Conn）
+func (s *Server) SetConnTimeouts(handshake, read, idle time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeouts = connTimeouts{handshake: handshake, read: read, idle: idle}
+}
+
+// SetMaxConns 设置最大连接数，超过时直接关闭新连接，0 表示不限制
+func (s *Server) SetMaxConns(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxConns = n
+}
+
+type deadlineConn interface {
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// timeoutConn 为读取消息设置超时：等待下一条消息时使用 idle 超时（有请求在处理时不限制），
+// 消息的第一个字节到达后改为 read 超时
+type timeoutConn struct {
+	io.ReadWriteCloser
+	conn       deadlineConn
+	read, idle time.Duration
+
+	mu      sync.Mutex
+	waiting bool // 正在等待下一条消息
+	idling  bool // 当前的读超时为 idle 超时
+}
+
+func newTimeoutConn(rwc io.ReadWriteCloser, t connTimeouts) *timeoutConn {
+	conn, ok := rwc.(deadlineConn)
+	if !ok || (t.read == 0 && t.idle == 0) {
+		return nil
+	}
+	return &timeoutConn{ReadWriteCloser: rwc, conn: conn, read: t.read, idle: t.idle}
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.started()
+	}
+	return n, err
+}
+
+func (c *timeoutConn) setDeadline(d time.Duration) {
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	_ = c.conn.SetReadDeadline(t)
+}
+
+// 开始等待下一条消息，idle 表示连接上没有处理中的请求
+func (c *timeoutConn) wait(idle bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waiting = true
+	c.idling = idle && c.idle > 0
+	if c.idling {
+		c.setDeadline(c.idle)
+	} else {
+		c.setDeadline(0)
+	}
+}
+
+// 一条消息开始到达，在 read 超时内读完
+func (c *timeoutConn) started() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.waiting {
+		c.waiting, c.idling = false, false
+		c.setDeadline(c.read)
+	}
+}
+
+// 连接上的请求都已处理完，等待中时开始计算 idle 超时
+func (c *timeoutConn) becameIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.waiting && !c.idling && c.idle > 0 {
+		c.idling = true
+		c.setDeadline(c.idle)
+	}
+}
+
+func (c *timeoutConn) timedOutIdle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.idling
+}
+
+func (sc *serverConn) waitMessage() {
+	if sc.tc != nil {
+		sc.tc.wait(atomic.LoadInt64(&sc.active) == 0)
+	}
+}
+
+func (sc *serverConn) messageStarted() {
+	if sc.tc != nil {
+		sc.tc.started()
+	}
+}
+
+// 一个请求处理完毕
+func (sc *serverConn) finish() {
+	if atomic.AddInt64(&sc.active, -1) == 0 && sc.tc != nil {
+		sc.tc.becameIdle()
+	}
+}
+
+// 读取失败时记录超时原因
+func (s *Server) readError(sc *serverConn, err error) {
+	if sc.tc == nil || !isTimeout(err) {
+		return
+	}
+	if sc.tc.timedOutIdle() {
+		s.connStats.idleClosed.Add(1)
+		return
+	}
+	s.connStats.readTimeouts.Add(1)
+	logger.Warn("rpc server: read timeout", "remote", sc.peer.RemoteAddr)
+}
+
+func (s *Server) handshakeError(err error) {
+	if isTimeout(err) {
+		s.connStats.handshakeTimeouts.Add(1)
+	}
+}
+
+// 没有设置握手超时时，读取被拒绝连接的 Option 最多等待的时间
+const rejectReadTimeout = time.Second
+
+// 读取 Option 后回复拒绝原因再关闭连接，客户端据此区分被拒绝和不识别前导字节的旧版本服务端。
+// 连接没有计入连接数，需要支持 SetDeadline 以限制等待的时间
+func rejectConn(dc deadlineConn, conn io.ReadWriter, timeout time.Duration, reason error) {
+	if timeout <= 0 {
+		timeout = rejectReadTimeout
+	}
+	_ = dc.SetDeadline(time.Now().Add(timeout))
+	if hs, _ := option.Read(conn, new(option.Option)); hs != nil {
+		_ = option.WriteReply(conn, hs, reason.Error())
+	}
+}
+
+var errCanceledByClient = errors.New("rpc server: request canceled by client")
+
+// 处理协商后的控制消息：取消调用和心跳。不是控制消息时返回 false
+func (s *Server) handleControl(sc *serverConn, h *codec.Header) (bool, error) {
+	switch {
+	case h.ServiceMethod == common.CancelMethod && sc.peer.Capabilities.Has(option.CapCancellation):
+		if cancel, ok := sc.calls.Load(h.Seq); ok {
+			cancel.(context.CancelCauseFunc)(errCanceledByClient)
+		}
+		return true, sc.cc.ReadBody(nil)
+	case h.ServiceMethod == common.PingMethod && sc.peer.Capabilities.Has(option.CapKeepalive):
+		if err := sc.cc.ReadBody(nil); err != nil {
+			return true, err
+		}
+		s.sendResponse(sc, h, invalidRequest)
+		return true, nil
+	}
+	return false, nil
+}
+
+// countingConn 统计连接读写的字节数。读取经过 bufio.Reader 并实现 io.ByteReader，
+// gob 解码器不再额外缓冲，读取的字节数与消息一致；JSON 解码器会预读，统计值为近似值
+type countingConn struct {
+	io.ReadWriteCloser
+	r       *bufio.Reader
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func newCountingConn(rwc io.ReadWriteCloser) *countingConn {
+	return &countingConn{ReadWriteCloser: rwc, r: bufio.NewReader(rwc)}
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.read.Add(1)
+	}
+	return b, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
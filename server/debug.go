@@ -1,24 +1,41 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"sync/atomic"
 	"text/template"
+	"time"
+
+	"github.com/felixorbit/fexrpc/logger"
 )
 
 const debugText = `<html>
 	<body>
 	<title>FexRPC Services</title>
-	{{range .}}
+	Uptime: {{.Uptime}}
+	<br>
+	{{with .Conns}}
+	Connections: {{.Active}} active, max {{if .Max}}{{.Max}}{{else}}unlimited{{end}}, {{.Rejected}} rejected
+	<br>
+	Timeouts: handshake {{.Handshake}}, read {{.Read}}, idle {{.Idle}} (0s means unlimited);
+	{{.HandshakeTimeouts}} handshake timeouts, {{.ReadTimeouts}} read timeouts, {{.IdleClosed}} idle closed
+	{{end}}
+	{{range .Services}}
 	<hr>
-	Service {{.Name}}
+	Service {{.Name}} ({{.Status}}, registered at {{.Registered.Format "2006-01-02 15:04:05"}})
 	<hr>
 		<table>
-		<th align=center>Method</th> <th align=center>Calls</th>
+		<th align=center>Method</th> <th align=center>Calls</th> <th align=center>Running</th> <th align=center>Panics</th> <th align=center>Late</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
 			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=center>{{$mtype.Running}}</td>
+			<td align=center>{{$mtype.NumPanics}}</td>
+			<td align=center>{{$mtype.NumLate}}</td>
 			</tr>
 		{{end}}
 		</table>
@@ -28,27 +45,203 @@ const debugText = `<html>
 
 var debug = template.Must(template.New("RPC debug").Parse(debugText))
 
+type debugPage struct {
+	Uptime   time.Duration
+	Conns    debugConns
+	Services []debugService
+}
+
+type debugConns struct {
+	Active, Max                               int
+	Handshake, Read, Idle                     time.Duration
+	Rejected, HandshakeTimeouts, ReadTimeouts uint64
+	IdleClosed                                uint64
+}
+
 type debugHTTP struct {
 	*Server
 }
 
 type debugService struct {
-	Name   string
-	Method map[string]*methodType
+	Name       string
+	Status     string // active：正在提供服务；retired：已注销或被替换，仍有请求在处理
+	Registered time.Time
+	Method     map[string]*methodType
 }
 
 func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	services := server.debugServices()
+	err := debug.Execute(w, debugPage{Uptime: server.uptime(), Conns: server.debugConns(), Services: services})
+	if err != nil {
+		_, _ = fmt.Fprintln(w, "rpc: error executing template: ", err.Error())
+	}
+}
+
+// 正在提供服务和已注销的服务，按服务名排序
+func (s *Server) debugServices() []debugService {
 	var services []debugService
-	server.serviceMap.Range(func(namei, svci interface{}) bool {
+	s.serviceMap.Range(func(namei, svci interface{}) bool {
 		svc := svci.(*service)
 		services = append(services, debugService{
-			Name:   namei.(string),
-			Method: svc.method,
+			Name:       namei.(string),
+			Status:     "active",
+			Registered: svc.registered,
+			Method:     svc.method,
 		})
 		return true
 	})
-	err := debug.Execute(w, services)
-	if err != nil {
-		_, _ = fmt.Fprintln(w, "rpc: error executing template: ", err.Error())
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	for _, svc := range s.retiredServices() {
+		services = append(services, debugService{
+			Name:       svc.name,
+			Status:     "retired",
+			Registered: svc.registered,
+			Method:     svc.method,
+		})
+	}
+	return services
+}
+
+func (s *Server) uptime() time.Duration {
+	return time.Since(s.started).Truncate(time.Second)
+}
+
+func (s *Server) debugConns() debugConns {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return debugConns{
+		Active:            len(s.activeConn),
+		Max:               s.maxConns,
+		Handshake:         s.timeouts.handshake,
+		Read:              s.timeouts.read,
+		Idle:              s.timeouts.idle,
+		Rejected:          s.connStats.rejected.Load(),
+		HandshakeTimeouts: s.connStats.handshakeTimeouts.Load(),
+		ReadTimeouts:      s.connStats.readTimeouts.Load(),
+		IdleClosed:        s.connStats.idleClosed.Load(),
+	}
+}
+
+// debugJSON 调试信息的 JSON 版本，供监控面板和脚本读取
+type debugJSON struct {
+	*Server
+}
+
+type debugJSONPage struct {
+	Started       time.Time          `json:"started"`
+	UptimeSeconds float64            `json:"uptime_seconds"`
+	Conns         debugJSONConns     `json:"connections"`
+	Services      []debugJSONService `json:"services"`
+}
+
+type debugJSONConns struct {
+	Active            int             `json:"active"`
+	Max               int             `json:"max"` // 0 表示不限制
+	Rejected          uint64          `json:"rejected"`
+	HandshakeTimeouts uint64          `json:"handshake_timeouts"`
+	ReadTimeouts      uint64          `json:"read_timeouts"`
+	IdleClosed        uint64          `json:"idle_closed"`
+	List              []debugJSONConn `json:"list"`
+}
+
+type debugJSONConn struct {
+	ID         uint64    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Transport  string    `json:"transport"`
+	State      string    `json:"state"` // handshake：正在协商或认证；serving：正在处理请求
+	Codec      string    `json:"codec,omitempty"`
+	Principal  string    `json:"principal,omitempty"`
+	Pending    int64     `json:"pending"` // 已读取、尚未响应的请求数
+	Since      time.Time `json:"since"`
+}
+
+type debugJSONService struct {
+	Name       string            `json:"name"`
+	Status     string            `json:"status"`
+	Registered time.Time         `json:"registered"`
+	Methods    []debugJSONMethod `json:"methods"`
+}
+
+type debugJSONMethod struct {
+	Name      string         `json:"name"`
+	ArgType   string         `json:"arg_type"`
+	ReplyType string         `json:"reply_type"`
+	Calls     uint64         `json:"calls"`
+	Running   int64          `json:"running"`
+	Panics    uint64         `json:"panics"`
+	Late      uint64         `json:"late"`
+	Latency   latencySummary `json:"latency"`
+	Errors    methodErrors   `json:"errors"`
+}
+
+func (server debugJSON) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conns := server.debugConns()
+	page := debugJSONPage{
+		Started:       server.started,
+		UptimeSeconds: time.Since(server.started).Seconds(),
+		Conns: debugJSONConns{
+			Active:            conns.Active,
+			Max:               conns.Max,
+			Rejected:          conns.Rejected,
+			HandshakeTimeouts: conns.HandshakeTimeouts,
+			ReadTimeouts:      conns.ReadTimeouts,
+			IdleClosed:        conns.IdleClosed,
+			List:              server.debugConnList(),
+		},
+		Services: []debugJSONService{},
+	}
+	for _, svc := range server.debugServices() {
+		js := debugJSONService{Name: svc.Name, Status: svc.Status, Registered: svc.Registered, Methods: []debugJSONMethod{}}
+		for name, mtype := range svc.Method {
+			latency, errs := mtype.stats.snapshot()
+			js.Methods = append(js.Methods, debugJSONMethod{
+				Name:      name,
+				ArgType:   mtype.ArgType.String(),
+				ReplyType: mtype.ReplyType.String(),
+				Calls:     mtype.NumCalls(),
+				Running:   mtype.Running(),
+				Panics:    mtype.NumPanics(),
+				Late:      mtype.NumLate(),
+				Latency:   latency,
+				Errors:    errs,
+			})
+		}
+		sort.Slice(js.Methods, func(i, j int) bool { return js.Methods[i].Name < js.Methods[j].Name })
+		page.Services = append(page.Services, js)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(page); err != nil {
+		logger.Warn("rpc server: write debug json error", "err", err)
+	}
+}
+
+// 活跃连接，按连接 ID 排序。完成协商后 Peer 的字段不再变化，在 s.mu 下通过 sc.cc 判断
+func (s *Server) debugConnList() []debugJSONConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]debugJSONConn, 0, len(s.activeConn))
+	for sc := range s.activeConn {
+		conn := debugJSONConn{
+			ID:        sc.peer.ID,
+			Transport: sc.peer.Transport,
+			State:     "handshake",
+			Since:     sc.since,
+		}
+		if sc.peer.RemoteAddr != nil {
+			conn.RemoteAddr = sc.peer.RemoteAddr.String()
+		}
+		if sc.cc != nil {
+			conn.State = "serving"
+			conn.Codec = sc.peer.Codec.String()
+			conn.Pending = atomic.LoadInt64(&sc.active)
+			if p := sc.peer.Principal; p != nil {
+				conn.Principal = p.Name
+			}
+		}
+		list = append(list, conn)
 	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
 }
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/option"
+)
+
+const (
+	// DefaultIdempotencyTTL 幂等调用结果的默认保存时间
+	DefaultIdempotencyTTL = 10 * time.Minute
+	// DefaultIdempotencyEntries 默认最多保存的幂等调用结果数
+	DefaultIdempotencyEntries = 10000
+)
+
+// 一次幂等调用的结果，done 关闭后 reply、code、errMsg 不再修改
+type idempotencyEntry struct {
+	key     string
+	done    chan struct{}
+	reply   interface{}
+	code    common.Code
+	errMsg  string
+	expires time.Time // 完成后开始计算，未完成时为零值
+	elem    *list.Element
+}
+
+// idempotencyCache 按幂等键保存调用结果，过期的结果被淘汰，超过数量上限时淘汰最早加入的结果
+type idempotencyCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	order   *list.List // 按加入顺序排列
+}
+
+func newIdempotencyCache(ttl time.Duration, maxEntries int) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*idempotencyEntry),
+		order:      list.New(),
+	}
+}
+
+// SetIdempotency 设置幂等调用结果的保存时间和最大数量，ttl 为 0 时不再去重：
+// 之后建立的连接不协商 option.CapIdempotency，已有连接上携带幂等键的调用返回错误。
+// 客户端通过 client.WithIdempotencyKey 指定幂等键，相同的键在 ttl 内只执行一次
+func (s *Server) SetIdempotency(ttl time.Duration, maxEntries int) {
+	if ttl <= 0 || maxEntries <= 0 {
+		s.idempotency.Store(nil)
+		return
+	}
+	s.idempotency.Store(newIdempotencyCache(ttl, maxEntries))
+}
+
+// 服务端支持的协议能力，关闭去重后不再声明 option.CapIdempotency
+func (s *Server) capabilities() option.Capability {
+	caps := option.DefaultCapabilities
+	if s.idempotency.Load() == nil {
+		caps &^= option.CapIdempotency
+	}
+	return caps
+}
+
+// 查找幂等键对应的调用，不存在时创建并返回 leader 为 true，由调用方执行后调用 finish
+func (c *idempotencyCache) begin(key string, now time.Time) (entry *idempotencyEntry, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict(now)
+	if e, ok := c.entries[key]; ok {
+		return e, false
+	}
+	for c.order.Len() >= c.maxEntries {
+		c.remove(c.order.Front())
+	}
+	e := &idempotencyEntry{key: key, done: make(chan struct{})}
+	e.elem = c.order.PushBack(e)
+	c.entries[key] = e
+	return e, true
+}
+
+// 记录调用结果，唤醒等待中的重复调用
+func (c *idempotencyCache) finish(e *idempotencyEntry, reply interface{}, code common.Code, errMsg string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.reply, e.code, e.errMsg = reply, code, errMsg
+	e.expires = time.Now().Add(c.ttl)
+	close(e.done)
+}
+
+// 调用被取消或超时而失败时不保存结果，之后使用相同幂等键的重试重新执行。
+// 正在等待的重复调用收到本次的错误
+func (c *idempotencyCache) abandon(e *idempotencyEntry, code common.Code, errMsg string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[e.key] == e {
+		c.remove(e.elem)
+	}
+	e.reply, e.code, e.errMsg = invalidRequest, code, errMsg
+	close(e.done)
+}
+
+// 淘汰已过期的结果
+func (c *idempotencyCache) evict(now time.Time) {
+	for elem := c.order.Front(); elem != nil; {
+		e := elem.Value.(*idempotencyEntry)
+		next := elem.Next()
+		switch {
+		case !e.expires.IsZero() && now.After(e.expires):
+			c.remove(elem)
+		case e.expires.IsZero():
+			// 跳过未完成的调用，之后可能还有已过期的结果
+		default:
+			return
+		}
+		elem = next
+	}
+}
+
+func (c *idempotencyCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*idempotencyEntry).key)
+}
+
+// 幂等键按客户端身份（未认证时使用对端 IP）和方法区分，不同客户端使用相同的键互不影响
+func idempotencyKey(p *Peer, serviceMethod, key string) string {
+	name, _, authenticated := peerIdentity(p)
+	if !authenticated {
+		name = "ip:" + peerIP(p)
+	}
+	return name + "|" + serviceMethod + "|" + key
+}
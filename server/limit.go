@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// workerPool 固定数量的 worker 处理请求，队列满时拒绝新请求，避免突发流量创建大量协程
+type workerPool struct {
+	mu     sync.RWMutex
+	closed bool
+	tasks  chan func()
+}
+
+func newWorkerPool(workers, queueSize int) *workerPool {
+	p := &workerPool{tasks: make(chan func(), queueSize)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+// 提交任务，队列已满或已停止时返回 false
+func (p *workerPool) submit(task func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// 停止接收任务，worker 处理完队列中剩余的任务后退出
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.tasks)
+	}
+}
+
+// SetConcurrency 设置全局并发限制：workers 个 worker 处理请求，最多 queueSize 个请求排队。
+// workers 为 0 时不限制，每个请求启动一个协程处理
+func (s *Server) SetConcurrency(workers, queueSize int) {
+	var pool *workerPool
+	if workers > 0 {
+		pool = newWorkerPool(workers, queueSize)
+	}
+	if old := s.pool.Swap(pool); old != nil {
+		old.stop()
+	}
+}
+
+// SetMethodConcurrency 设置单个方法同时处理（含排队）的请求数上限，0 表示不限制
+func (s *Server) SetMethodConcurrency(serviceMethod string, limit int) error {
+	_, mtype, err := s.findService(serviceMethod)
+	if err != nil {
+		return err
+	}
+	if limit < 0 {
+		return errors.New("rpc server: invalid concurrency limit")
+	}
+	atomic.StoreInt64(&mtype.maxConcurrent, int64(limit))
+	return nil
+}
+
+func (m *methodType) acquire() bool {
+	n := atomic.AddInt64(&m.running, 1)
+	if max := atomic.LoadInt64(&m.maxConcurrent); max > 0 && n > max {
+		atomic.AddInt64(&m.running, -1)
+		return false
+	}
+	return true
+}
+
+func (m *methodType) release() {
+	atomic.AddInt64(&m.running, -1)
+}
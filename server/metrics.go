@@ -0,0 +1,81 @@
+package server
+
+import (
+	"time"
+
+	"github.com/felixorbit/fexrpc/codec"
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/metrics"
+)
+
+// serverMetrics 服务端指标，请求类指标按方法区分，找不到的方法记为 unknown，避免任意方法名产生大量序列
+type serverMetrics struct {
+	registry *metrics.Registry
+	requests *metrics.CounterVec
+	errors   *metrics.CounterVec
+	latency  *metrics.HistogramVec
+	inFlight *metrics.GaugeVec
+	bytesIn  *metrics.CounterVec
+	bytesOut *metrics.CounterVec
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		requests: r.Counter("fexrpc_server_requests_total", "Requests received by method.", "method"),
+		errors:   r.Counter("fexrpc_server_errors_total", "Requests answered with an error by method and code.", "method", "code"),
+		latency:  r.Histogram("fexrpc_server_request_duration_seconds", "Time from reading the request header to sending the response.", nil, "method"),
+		inFlight: r.Gauge("fexrpc_server_in_flight_requests", "Requests read but not yet answered.", "method"),
+		bytesIn:  r.Counter("fexrpc_server_received_bytes_total", "Request bytes read by method.", "method"),
+		bytesOut: r.Counter("fexrpc_server_sent_bytes_total", "Response bytes written by method.", "method"),
+	}
+	r.GaugeFunc("fexrpc_server_connections", "Connections currently open.", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(len(s.activeConn))
+	})
+	r.CounterFunc("fexrpc_server_connections_total", "Connections accepted.", func() float64 {
+		return float64(s.nextConnID.Load())
+	})
+	r.CounterFunc("fexrpc_server_connections_rejected_total", "Connections rejected by the connection limit.", func() float64 {
+		return float64(s.connStats.rejected.Load())
+	})
+	return m
+}
+
+// Metrics 服务端的指标集合，HandleHTTP 在 common.DefaultMetricsPath 输出，也可以挂载到其他 HTTP 服务
+func (s *Server) Metrics() *metrics.Registry {
+	return s.metrics.registry
+}
+
+// 指标中使用的方法名
+func (s *Server) methodLabel(req *request) string {
+	if req.mtype == nil {
+		if _, _, err := s.findService(req.h.ServiceMethod); err != nil {
+			return "unknown"
+		}
+	}
+	return req.h.ServiceMethod
+}
+
+// 读到请求时记录
+func (m *serverMetrics) begin(method string, size int64) {
+	m.requests.With(method).Inc()
+	m.inFlight.With(method).Inc()
+	m.bytesIn.With(method).Add(float64(size))
+}
+
+// 发送响应后记录
+func (m *serverMetrics) finish(method string, start time.Time, h *codec.Header, size int64) {
+	m.inFlight.With(method).Dec()
+	m.latency.With(method).Observe(time.Since(start).Seconds())
+	m.bytesOut.With(method).Add(float64(size))
+	if h.Error != "" {
+		code := h.Code
+		if code == common.CodeOK {
+			code = common.CodeUnknown
+		}
+		m.errors.With(method, code.String()).Inc()
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"github.com/felixorbit/fexrpc/auth"
+	"github.com/felixorbit/fexrpc/codec"
+	"github.com/felixorbit/fexrpc/option"
+)
+
+// Peer 一次连接的对端信息和会话状态，生命周期与连接相同。
+// 方法的第一个参数为 context.Context 时，可以通过 PeerFromContext 获取
+type Peer struct {
+	ID           uint64   // 连接 ID，同一个 Server 内唯一
+	RemoteAddr   net.Addr // 对端地址，连接不是 net.Conn 时为 nil
+	LocalAddr    net.Addr
+	Transport    string               // 传输方式：tcp / tls / unix / http / https 等
+	Codec        codec.CType          // 协商的编解码方式
+	Option       option.Option        // 客户端发送的 Option
+	Capabilities option.Capability    // 协商后双方都支持的协议能力
+	TLS          *tls.ConnectionState // 未使用 TLS 时为 nil
+	TLSIdentity  string               // mTLS 校验通过的客户端证书身份，未校验时为空
+	Cred         *PeerCred            // Unix Domain Socket 对端进程的凭证，其他传输方式为 nil
+	Principal    *auth.Principal      // 认证通过的主体，服务端未开启认证时为 nil
+
+	values  sync.Map // 会话级 key/value 存储
+	reverse *reverseCaller
+}
+
+// Get 获取会话中保存的值
+func (p *Peer) Get(key interface{}) (interface{}, bool) {
+	return p.values.Load(key)
+}
+
+// Set 在会话中保存值，连接关闭后释放
+func (p *Peer) Set(key, value interface{}) {
+	p.values.Store(key, value)
+}
+
+// Delete 删除会话中保存的值
+func (p *Peer) Delete(key interface{}) {
+	p.values.Delete(key)
+}
+
+type peerKey struct{}
+
+// PeerFromContext 获取处理请求的连接信息
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+// 根据连接类型填充对端信息，transport 为空时使用连接的网络类型
+func newPeer(id uint64, conn interface{}, transport string) *Peer {
+	p := &Peer{ID: id, Transport: transport}
+	if nc, ok := conn.(net.Conn); ok {
+		p.RemoteAddr = nc.RemoteAddr()
+		p.LocalAddr = nc.LocalAddr()
+		if p.Transport == "" && p.LocalAddr != nil {
+			p.Transport = p.LocalAddr.Network()
+		}
+	}
+	p.Cred = peerCred(conn)
+	return p
+}
+
+// 读取 Option 后 TLS 握手已完成，补充协商结果
+func (p *Peer) handshakeDone(conn interface{}, opt *option.Option) {
+	p.Option = *opt
+	p.Codec = opt.CodecType
+	if tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := tc.ConnectionState()
+		p.TLS = &state
+		p.TLSIdentity = tlsIdentity(&state)
+		switch p.Transport {
+		case "tcp":
+			p.Transport = "tls"
+		case "http":
+			p.Transport = "https"
+		}
+	}
+}
+
+// Call 通过该连接调用客户端注册的服务（反向调用），客户端需要通过 client.Client.Register 注册服务。
+// 旧版本客户端会把反向调用当作相同 Seq 的响应，协商结果不包含 option.CapReverse 时返回 ErrReverseUnsupported
+func (p *Peer) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	if !p.Capabilities.Has(option.CapReverse) {
+		return ErrReverseUnsupported
+	}
+	return p.reverse.call(ctx, serviceMethod, args, reply)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"math"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/felixorbit/fexrpc/common"
+)
+
+// RateLimitKey 限流分桶的维度，可以组合使用
+type RateLimitKey int
+
+const (
+	LimitByIdentity RateLimitKey = 1 << iota // 认证主体或 mTLS 身份，未认证时使用对端 IP
+	LimitByIP                                // 对端 IP，非 IP 地址时使用完整地址
+	LimitByMethod                            // 服务方法
+)
+
+// RateLimit 令牌桶限流规则：按 Key 指定的维度分桶，每个桶每秒补充 Rate 个令牌，最多累积 Burst 个
+type RateLimit struct {
+	Key     RateLimitKey
+	Methods []string // 生效的 "Service.Method" 模式，支持 path.Match 通配，为空时作用于所有方法
+	Rate    float64
+	Burst   int
+}
+
+// 超过该数量的桶时清理已经补满的桶，避免按 IP 分桶时无限增长。清理最多每 sweepInterval 进行一次
+const (
+	maxIdleBuckets = 10000
+	sweepInterval  = time.Second
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  *RateLimit // 桶所属的规则
+}
+
+// 取一个令牌，令牌不足时返回需要等待的时间
+func (b *tokenBucket) take(now time.Time, limit *RateLimit) (bool, time.Duration) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if limit.Rate <= 0 {
+		return false, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+type rateLimiter struct {
+	limits    []RateLimit
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// SetRateLimits 设置限流规则，可以在运行时更新，更新后所有桶重新计数。不传参数表示不限流
+func (s *Server) SetRateLimits(limits ...RateLimit) {
+	if len(limits) == 0 {
+		s.limiter.Store(nil)
+		return
+	}
+	s.limiter.Store(&rateLimiter{limits: limits, buckets: make(map[string]*tokenBucket)})
+}
+
+func (l *RateLimit) matchMethod(serviceMethod string) bool {
+	if len(l.Methods) == 0 {
+		return true
+	}
+	for _, pattern := range l.Methods {
+		if ok, _ := path.Match(pattern, serviceMethod); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *RateLimit) bucketKey(index int, p *Peer, serviceMethod string) string {
+	parts := []string{strconv.Itoa(index)}
+	if l.Key&LimitByIdentity != 0 {
+		// 未认证的调用方身份都为空，按对端 IP 区分，避免共用一个桶
+		name, _, authenticated := peerIdentity(p)
+		if !authenticated {
+			name = "ip:" + peerIP(p)
+		}
+		parts = append(parts, "id="+name)
+	}
+	if l.Key&LimitByIP != 0 {
+		parts = append(parts, "ip="+peerIP(p))
+	}
+	if l.Key&LimitByMethod != 0 {
+		parts = append(parts, "method="+serviceMethod)
+	}
+	return strings.Join(parts, "|")
+}
+
+func peerIP(p *Peer) string {
+	if p.RemoteAddr == nil {
+		return ""
+	}
+	addr := p.RemoteAddr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// 所有匹配的规则都有令牌时才放行，否则返回最长的等待时间
+func (r *rateLimiter) allow(p *Peer, serviceMethod string, now time.Time) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.buckets) > maxIdleBuckets && now.Sub(r.lastSweep) >= sweepInterval {
+		r.sweep(now)
+	}
+	allowed, retryAfter := true, time.Duration(0)
+	for i := range r.limits {
+		limit := &r.limits[i]
+		if !limit.matchMethod(serviceMethod) {
+			continue
+		}
+		key := limit.bucketKey(i, p, serviceMethod)
+		b, ok := r.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(limit.Burst), last: now, limit: limit}
+			r.buckets[key] = b
+		}
+		if ok, wait := b.take(now, limit); !ok {
+			allowed = false
+			if wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	return allowed, retryAfter
+}
+
+// 删除已经补满的桶，它们与新建的桶等价
+func (r *rateLimiter) sweep(now time.Time) {
+	r.lastSweep = now
+	for key, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= float64(b.limit.Burst) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// 检查请求是否超过限流，超过时返回携带重试等待时间的错误
+func (s *Server) rateLimit(p *Peer, serviceMethod string) error {
+	limiter := s.limiter.Load()
+	if limiter == nil || p == nil {
+		return nil
+	}
+	ok, retryAfter := limiter.allow(p, serviceMethod, time.Now())
+	if ok {
+		return nil
+	}
+	se := &statusError{
+		code: common.CodeResourceExhausted,
+		msg:  "rpc server: resource exhausted: rate limit exceeded for " + serviceMethod,
+	}
+	if retryAfter > 0 {
+		se.meta = map[string]string{common.MetaRetryAfter: retryAfter.String()}
+	}
+	return se
+}
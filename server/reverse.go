@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/felixorbit/fexrpc/codec"
+	"github.com/felixorbit/fexrpc/common"
+)
+
+// ErrConnClosed 连接已关闭，无法发起反向调用
+var ErrConnClosed = errors.New("rpc server: connection is closed")
+
+// ErrReverseUnsupported 客户端没有声明 option.CapReverse，无法识别反向调用
+var ErrReverseUnsupported = errors.New("rpc server: client doesn't support reverse calls")
+
+// 服务端发起的一次反向调用
+type reverseCall struct {
+	reply interface{}
+	err   error
+	done  chan struct{}
+}
+
+// reverseCaller 在服务端连接上向客户端发起调用，与正向调用共用连接和发送锁，Seq 独立分配
+type reverseCaller struct {
+	sc      *serverConn
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]*reverseCall
+	closed  bool
+}
+
+func newReverseCaller(sc *serverConn) *reverseCaller {
+	return &reverseCaller{sc: sc, seq: 1, pending: make(map[uint64]*reverseCall)}
+}
+
+func (r *reverseCaller) register(call *reverseCall) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.sc.cc == nil {
+		return 0, ErrConnClosed
+	}
+	seq := r.seq
+	r.seq++
+	r.pending[seq] = call
+	return seq, nil
+}
+
+func (r *reverseCaller) remove(seq uint64) *reverseCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	call := r.pending[seq]
+	delete(r.pending, seq)
+	return call
+}
+
+func (r *reverseCaller) call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	call := &reverseCall{reply: reply, done: make(chan struct{})}
+	seq, err := r.register(call)
+	if err != nil {
+		return err
+	}
+	h := &codec.Header{ServiceMethod: serviceMethod, Seq: seq, Reverse: true}
+	r.sc.sending.Lock()
+	err = r.sc.cc.Write(h, args)
+	r.sc.sending.Unlock()
+	if err != nil {
+		r.remove(seq)
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		r.remove(seq)
+		return errors.New("rpc server: reverse call failed: " + ctx.Err().Error())
+	case <-call.done:
+		return call.err
+	}
+}
+
+// 读取客户端对反向调用的响应
+func (r *reverseCaller) receive(cc codec.Codec, h *codec.Header) error {
+	call := r.remove(h.Seq)
+	switch {
+	case call == nil:
+		return cc.ReadBody(nil)
+	case h.Error != "":
+		call.err = &ReverseError{Code: h.Code, Msg: h.Error}
+		err := cc.ReadBody(nil)
+		close(call.done)
+		return err
+	default:
+		err := cc.ReadBody(call.reply)
+		if err != nil {
+			call.err = errors.New("reading body " + err.Error())
+		}
+		close(call.done)
+		return err
+	}
+}
+
+// 连接断开，结束所有等待中的反向调用
+func (r *reverseCaller) terminate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for seq, call := range r.pending {
+		call.err = ErrConnClosed
+		close(call.done)
+		delete(r.pending, seq)
+	}
+}
+
+// ReverseError 客户端处理反向调用时返回的错误
+type ReverseError struct {
+	Code common.Code
+	Msg  string
+}
+
+func (e *ReverseError) Error() string {
+	return e.Msg
+}
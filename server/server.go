@@ -1,48 +1,177 @@
 package server
 
 import (
-	"encoding/binary"
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/felixorbit/fexrpc/option"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/felixorbit/fexrpc/auth"
 	"github.com/felixorbit/fexrpc/codec"
 	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/internal/dispatch"
+	"github.com/felixorbit/fexrpc/logger"
+	"github.com/felixorbit/fexrpc/metrics"
+	"github.com/felixorbit/fexrpc/trace"
 )
 
 // Server 用来提供 RPC 服务的服务器
 type Server struct {
 	serviceMap sync.Map // 存储所有注册的服务
 	addr       string
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	activeConn map[*serverConn]struct{}
+	retired    []*service // 已注销或被替换、仍有请求在处理的服务
+	nextConnID atomic.Uint64
+	inShutdown atomic.Bool // 正在关闭，不再接受新连接
+	timeouts   connTimeouts
+	maxConns   int // 最大连接数，0 表示不限制
+	connStats  connStats
+
+	pool    atomic.Pointer[workerPool]  // 全局并发限制，nil 表示不限制
+	repanic atomic.Bool                 // 方法 panic 时在响应后重新 panic，用于调试
+	acl     atomic.Pointer[ACL]         // 访问控制列表，nil 表示不限制
+	limiter atomic.Pointer[rateLimiter] // 限流规则，nil 表示不限流
+
+	idempotency  atomic.Pointer[idempotencyCache] // 幂等调用结果，nil 表示不去重
+	accessLogCfg atomic.Pointer[AccessLog]        // 访问日志配置，nil 表示不记录
+	metrics      *serverMetrics
+	started      time.Time // 创建时间，用于计算运行时长
+
+	authenticators map[string]auth.Authenticator // 按 Scheme 索引，为空时不需要认证
+
+	defaultTimeout time.Duration // 客户端未指定处理超时时使用
+	maxTimeout     time.Duration // 允许客户端指定的最大处理超时
+}
+
+// 服务端维护的一次连接
+type serverConn struct {
+	ctx     context.Context // 连接关闭时取消，作为请求 context 的父节点
+	cancel  context.CancelFunc
+	rwc     io.ReadWriteCloser
+	peer    *Peer
+	reverse *reverseCaller // 服务端发起的反向调用
+	cc      codec.Codec    // 完成 Option 协商后设置
+	sending sync.Mutex     // 保证发送一次完整响应
+	active  int64          // 正在处理的请求数
+	calls   sync.Map       // 可以被客户端取消的请求，Seq -> context.CancelCauseFunc
+	tc      *timeoutConn   // 读超时控制，未配置超时时为 nil
+	counter *countingConn  // 统计读写的字节数
+	since   time.Time      // 建立连接的时间
 }
 
+// shutdownPollInterval Shutdown 检查连接是否空闲的间隔
+const shutdownPollInterval = 50 * time.Millisecond
+
 // 表示一次 RPC 调用请求
 type request struct {
 	h            *codec.Header
 	svc          *service
 	mtype        *methodType
 	argv, replyv reflect.Value
+	id           string // 请求 ID，客户端未指定时由连接 ID 和 Seq 生成
+	method       string // 指标中使用的方法名
+	span         *trace.Span
+	start        time.Time // 读到 header 的时间
+	size         int64     // 请求的字节数
 }
 
 var invalidRequest = struct{}{}
 
+// 响应使用请求 header 的副本，不回传请求中的元数据
+func (req *request) responseHeader() *codec.Header {
+	h := *req.h
+	h.Meta = nil
+	return &h
+}
+
+// statusError 携带状态码的错误，返回给客户端时写入 Header.Code
+type statusError struct {
+	code common.Code
+	msg  string
+	meta map[string]string // 需要随响应返回的元数据
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// 获取错误的状态码，不是 statusError 时返回 def
+func errorCode(err error, def common.Code) common.Code {
+	if se, ok := err.(*statusError); ok {
+		return se.code
+	}
+	return def
+}
+
 func NewServer() *Server {
-	return &Server{}
+	s := &Server{
+		listeners:  make(map[net.Listener]struct{}),
+		activeConn: make(map[*serverConn]struct{}),
+		started:    time.Now(),
+	}
+	s.metrics = newServerMetrics(s)
+	s.SetIdempotency(DefaultIdempotencyTTL, DefaultIdempotencyEntries)
+	return s
 }
 
 func (s *Server) SetAddr(addr string) {
 	s.addr = addr
 }
 
+// SetTimeouts 设置服务端的处理超时策略，需要在启动服务前调用。
+// defaultTimeout 在客户端未指定 HandleTimeout 时使用，maxTimeout 限制客户端指定的值，0 表示不限制。
+// 注册时通过 option.MethodOption 指定的方法级配置优先
+func (s *Server) SetTimeouts(defaultTimeout, maxTimeout time.Duration) {
+	s.defaultTimeout = defaultTimeout
+	s.maxTimeout = maxTimeout
+}
+
+// 根据服务端策略计算请求的处理超时，同时返回生效的配置来源
+func (s *Server) handleTimeout(mtype *methodType, requested time.Duration) (time.Duration, string) {
+	defaultTimeout, defaultSource := s.defaultTimeout, "server default timeout"
+	if mtype.timeout > 0 {
+		defaultTimeout, defaultSource = mtype.timeout, "method default timeout"
+	}
+	maxTimeout, maxSource := s.maxTimeout, "server max timeout"
+	if mtype.maxTimeout > 0 {
+		maxTimeout, maxSource = mtype.maxTimeout, "method max timeout"
+	}
+	timeout, source := requested, "client timeout"
+	if timeout == 0 {
+		timeout, source = defaultTimeout, defaultSource
+	}
+	if maxTimeout > 0 && (timeout == 0 || timeout > maxTimeout) {
+		timeout, source = maxTimeout, maxSource
+	}
+	return timeout, source
+}
+
+// SetAuthenticators 设置认证器，需要在启动服务前调用。设置后客户端必须在 Option 协商后通过其中一种方式完成认证，
+// 认证主体可以通过 Peer.Principal 获取
+func (s *Server) SetAuthenticators(authenticators ...auth.Authenticator) {
+	s.authenticators = make(map[string]auth.Authenticator)
+	for _, a := range authenticators {
+		s.authenticators[a.Scheme()] = a
+	}
+}
+
+// SetRepanic 方法 panic 时默认恢复并返回内部错误，开启后会在返回响应后重新 panic，便于调试
+func (s *Server) SetRepanic(repanic bool) {
+	s.repanic.Store(repanic)
+}
+
 func (s *Server) findService(serviceMethod string) (svc *service, mtype *methodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
@@ -67,135 +196,517 @@ func (s *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	var h codec.Header
 	if err := cc.ReadHeader(&h); err != nil {
 		if err != io.EOF && err != io.ErrUnexpectedEOF {
-			log.Printf("[%s] rpc server: read header error: %+v", s.addr, err)
+			logger.Warn("rpc server: read header error", "addr", s.addr, "err", err)
 		}
 		return nil, err
 	}
 	return &h, nil
 }
 
-// 读一次 RPC 调用的请求，包括：header、调用方法、参数、响应，返回一个 request 实例
-func (s *Server) readRequest(cc codec.Codec) (*request, error) {
-	h, err := s.readRequestHeader(cc)
-	if err != nil {
-		return nil, err
+// 读一次 RPC 调用的请求，包括：header、调用方法、参数、响应，返回一个 request 实例。
+// 读到的反向调用响应交给 sc 处理后继续读取
+func (s *Server) readRequest(sc *serverConn) (*request, error) {
+	cc := sc.cc
+	for {
+		sc.waitMessage()
+		read := sc.counter.read.Load()
+		h, err := s.readRequestHeader(cc)
+		if err != nil {
+			s.readError(sc, err)
+			return nil, err
+		}
+		sc.messageStarted()
+		if h.Reverse {
+			if err = sc.reverse.receive(cc, h); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if handled, err := s.handleControl(sc, h); handled || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		start := time.Now()
+		req, err := s.newRequest(h, cc.ReadBody, sc.peer)
+		if req == nil {
+			req = &request{h: h}
+		}
+		req.start, req.size = start, sc.counter.read.Load()-read
+		req.id = h.Meta[common.MetaRequestID]
+		if req.id == "" {
+			req.id = fmt.Sprintf("%d-%d", sc.peer.ID, h.Seq)
+		}
+		req.method = s.methodLabel(req)
+		s.metrics.begin(req.method, req.size)
+		req.span = startServerSpan(sc, req)
+		return req, err
 	}
+}
+
+// 检查 peer 的访问权限后根据 header 查找方法，通过 readBody 读取参数。
+// 先检查权限，没有权限时无论方法是否存在都返回相同的错误。找不到方法或没有权限时不解码参数，读取并丢弃 body
+func (s *Server) newRequest(h *codec.Header, readBody func(interface{}) error, peer *Peer) (*request, error) {
 	req := &request{h: h}
-	req.svc, req.mtype, err = s.findService(h.ServiceMethod)
-	if err != nil {
-		return req, err
+	err := s.authorize(peer, h.ServiceMethod)
+	if err == nil {
+		req.svc, req.mtype, err = s.findService(h.ServiceMethod)
+	}
+	if err == nil {
+		err = s.rateLimit(peer, h.ServiceMethod)
 	}
-	req.argv = req.mtype.newArgv()
-	req.replyv = req.mtype.newReplyv()
-	argvInter := req.argv.Interface()
-	if req.argv.Type().Kind() != reflect.Ptr {
-		argvInter = req.argv.Addr().Interface()
+	if err != nil {
+		_ = readBody(nil)
+		return nil, err
 	}
-	if err = cc.ReadBody(argvInter); err != nil {
-		log.Println("rpc server: read argv error: ", err)
+	req.argv = req.mtype.NewArgv()
+	req.replyv = req.mtype.NewReplyv()
+	if err = readBody(dispatch.Body(req.argv)); err != nil {
+		logger.Warn("rpc server: read argv error", "err", err)
 	}
 	return req, nil
 }
 
-// 执行请求，并返回响应
-func (s *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
-	defer wg.Done()
-	// 执行阶段同步，超时控制
+// 执行请求，并返回响应。无论是否超时，每个请求只会发送一次响应。
+// 方法返回前一直占用 worker 和方法的并发配额，超时后仍在运行的方法同样受并发限制
+func (s *Server) handleRequest(sc *serverConn, req *request, wg *sync.WaitGroup, requested time.Duration) {
+	defer req.mtype.release()
+	// 响应后连接不再等待该请求
+	finished := sync.OnceFunc(func() {
+		sc.finish()
+		wg.Done()
+	})
+	defer finished()
+	timeout, source := s.handleTimeout(req.mtype, requested)
+	// 客户端取消调用时以 errCanceledByClient 结束 context
+	parent, cancelCause := context.WithCancelCause(trace.ContextWithSpan(sc.ctx, req.span))
+	defer cancelCause(nil)
+	if sc.peer.Capabilities.Has(option.CapCancellation) {
+		sc.calls.Store(req.h.Seq, cancelCause)
+		defer sc.calls.Delete(req.h.Seq)
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	defer cancel()
+	// 可缓存方法的结果未过期时直接返回，不执行方法
+	var key string
+	var cacheable bool
+	if req.mtype.cache != nil {
+		if key, cacheable = common.CacheKey(req.h.ServiceMethod, req.argv.Interface()); cacheable {
+			if reply, expires, ok := req.mtype.cache.Get(key, time.Now()); ok {
+				h := req.responseHeader()
+				if sc.peer.Capabilities.Has(option.CapMetadata) {
+					h.Meta = map[string]string{common.MetaCacheHit: "true", common.MetaCacheTTL: time.Until(expires).String()}
+				}
+				s.respond(sc, req, h, reply)
+				return
+			}
+		}
+	}
+	// 携带幂等键的重复调用等待第一次调用的结果，不再执行方法
+	var entry *idempotencyEntry
+	cache := s.idempotency.Load()
+	if key := req.h.Meta[common.MetaIdempotencyKey]; key != "" {
+		// 协商后关闭了去重时不能保证只执行一次，拒绝调用
+		if cache == nil {
+			h := req.responseHeader()
+			h.Code = common.CodeUnavailable
+			h.Error = "rpc server: idempotency is disabled, can't deduplicate " + req.h.ServiceMethod
+			s.respond(sc, req, h, invalidRequest)
+			return
+		}
+		var leader bool
+		entry, leader = cache.begin(idempotencyKey(sc.peer, req.h.ServiceMethod, key), time.Now())
+		if !leader {
+			s.replayIdempotent(ctx, sc, req, entry, timeout, source)
+			return
+		}
+	}
+	// 方法执行完成与超时竞争发送响应的权利，保证只响应一次
+	var responded atomic.Bool
 	called := make(chan struct{})
-	// 发送阶段同步
-	sent := make(chan struct{})
 	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		called <- struct{}{}
-		if err != nil {
-			req.h.Error = err.Error()
-			s.sendResponse(cc, req.h, invalidRequest, sending)
-			sent <- struct{}{}
+		defer close(called)
+		err := req.svc.call(ctx, req.mtype, req.argv, req.replyv)
+		h := req.responseHeader()
+		var body interface{} = invalidRequest
+		pe, panicked := err.(*dispatch.PanicError)
+		switch {
+		case panicked:
+			logger.Error("rpc server: panic serving", "method", h.ServiceMethod, "panic", pe.Value, "stack", string(pe.Stack))
+			h.Code = common.CodeInternal
+			h.Error = "rpc server: internal error serving " + h.ServiceMethod
+		case err != nil:
+			h.Code = common.CodeUnknown
+			h.Error = err.Error()
+		default:
+			body = req.replyv.Interface()
+			if cacheable {
+				req.mtype.cache.Set(key, body, time.Now().Add(req.mtype.cacheTTL))
+				if sc.peer.Capabilities.Has(option.CapMetadata) {
+					h.Meta = map[string]string{common.MetaCacheTTL: req.mtype.cacheTTL.String()}
+				}
+			}
+		}
+		// 超时后完成的结果同样记录，之后的重复调用可以直接获取；
+		// context 结束导致的失败不记录，否则客户端超时后的重试会一直得到取消错误
+		if entry != nil {
+			if ctx.Err() != nil && err != nil {
+				cache.abandon(entry, h.Code, h.Error)
+			} else {
+				cache.finish(entry, body, h.Code, h.Error)
+			}
+		}
+		// context 已结束时由超时分支响应，方法的结果被丢弃
+		if ctx.Err() != nil || !responded.CompareAndSwap(false, true) {
+			atomic.AddUint64(&req.mtype.numLate, 1)
 			return
 		}
-		s.sendResponse(cc, req.h, req.replyv.Interface(), sending)
-		sent <- struct{}{}
+		s.respond(sc, req, h, body)
+		if panicked && s.repanic.Load() {
+			panic(pe.Value)
+		}
 	}()
-	if timeout == 0 {
-		<-called
-		<-sent
-		return
-	}
 	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		s.sendResponse(cc, req.h, invalidRequest, sending)
 	case <-called:
-		<-sent
+	case <-ctx.Done():
+	}
+	if responded.CompareAndSwap(false, true) {
+		s.sendAborted(ctx, sc, req, timeout, source)
+	}
+	finished()
+	<-called
+}
+
+// 请求超时或被取消时响应
+func (s *Server) sendAborted(ctx context.Context, sc *serverConn, req *request, timeout time.Duration, source string) {
+	h := req.responseHeader()
+	if ctx.Err() == context.DeadlineExceeded {
+		h.Code = common.CodeDeadlineExceeded
+		h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s (%s)", timeout, source)
+	} else if context.Cause(ctx) == errCanceledByClient {
+		h.Code = common.CodeCanceled
+		h.Error = "rpc server: request canceled by client"
+	} else {
+		h.Code = common.CodeUnavailable
+		h.Error = "rpc server: request canceled: connection closed"
+	}
+	s.respond(sc, req, h, invalidRequest)
+}
+
+// 等待相同幂等键的第一次调用完成，返回它的结果
+func (s *Server) replayIdempotent(ctx context.Context, sc *serverConn, req *request, entry *idempotencyEntry, timeout time.Duration, source string) {
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		s.sendAborted(ctx, sc, req, timeout, source)
+		return
+	}
+	h := req.responseHeader()
+	h.Code, h.Error = entry.code, entry.errMsg
+	if sc.peer.Capabilities.Has(option.CapMetadata) {
+		h.Meta = map[string]string{common.MetaIdempotentReplay: "true"}
+	}
+	s.respond(sc, req, h, entry.reply)
+}
+
+// 发送响应，返回写入的字节数
+func (s *Server) sendResponse(sc *serverConn, header *codec.Header, body interface{}) int64 {
+	sc.sending.Lock()
+	defer sc.sending.Unlock()
+	written := sc.counter.written.Load()
+	if err := sc.cc.Write(header, body); err != nil {
+		logger.Warn("rpc server: write response error", "err", err)
 	}
+	return sc.counter.written.Load() - written
 }
 
-func (s *Server) sendResponse(cc codec.Codec, header *codec.Header, body interface{}, sending *sync.Mutex) {
-	sending.Lock()
-	defer sending.Unlock()
-	if err := cc.Write(header, body); err != nil {
-		log.Println("rpc server: write response error: ", err)
+// 响应请求，记录指标和访问日志
+func (s *Server) respond(sc *serverConn, req *request, h *codec.Header, body interface{}) {
+	size := s.sendResponse(sc, h, body)
+	s.metrics.finish(req.method, req.start, h, size)
+	if req.mtype != nil {
+		req.mtype.stats.observe(time.Since(req.start), h.Code, h.Error)
 	}
+	req.span.SetStatus(h.Code, h.Error)
+	req.span.End()
+	s.accessLog(sc, req, h, size)
 }
 
-func (s *Server) serveCodec(cc codec.Codec, opt *option.Option) {
-	sending := &sync.Mutex{}
+func (s *Server) serveCodec(sc *serverConn, opt *option.Option) {
+	cc := sc.cc
 	wg := &sync.WaitGroup{}
 	for {
-		req, err := s.readRequest(cc)
+		req, err := s.readRequest(sc)
 		if err != nil {
 			if req == nil {
 				break
 			}
-			req.h.Error = err.Error()
-			s.sendResponse(cc, req.h, invalidRequest, sending)
+			h := req.responseHeader()
+			h.Code = errorCode(err, common.CodeNotFound)
+			if se, ok := err.(*statusError); ok && sc.peer.Capabilities.Has(option.CapMetadata) {
+				h.Meta = se.meta
+			}
+			h.Error = err.Error()
+			s.respond(sc, req, h, invalidRequest)
+			continue
+		}
+		if !req.mtype.acquire() {
+			h := req.responseHeader()
+			h.Code = common.CodeResourceExhausted
+			h.Error = "rpc server: resource exhausted: too many concurrent requests for " + req.h.ServiceMethod
+			s.respond(sc, req, h, invalidRequest)
 			continue
 		}
 		wg.Add(1)
-		go s.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		atomic.AddInt64(&sc.active, 1)
+		task := func() {
+			s.handleRequest(sc, req, wg, opt.HandleTimeout)
+		}
+		if pool := s.pool.Load(); pool == nil {
+			go task()
+		} else if !pool.submit(task) {
+			req.mtype.release()
+			sc.finish()
+			wg.Done()
+			h := req.responseHeader()
+			h.Code = common.CodeResourceExhausted
+			h.Error = "rpc server: resource exhausted: request queue is full"
+			s.respond(sc, req, h, invalidRequest)
+		}
 	}
+	// 连接已断开，取消正在处理的请求和反向调用
+	sc.cancel()
+	sc.reverse.terminate()
 	wg.Wait()
 	_ = cc.Close()
 }
 
+// 通知客户端服务即将关闭，不要在该连接上发起新的请求。sc 需要已完成协商
+func (s *Server) goAway(sc *serverConn) {
+	s.sendResponse(sc, &codec.Header{ServiceMethod: common.GoAwayMethod}, invalidRequest)
+}
+
+var (
+	errShuttingDown = errors.New("server shutting down")
+	errTooManyConns = errors.New("too many connections")
+)
+
+// 添加连接时返回拒绝的原因
+func (s *Server) trackConn(sc *serverConn, add bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.inShutdown.Load() {
+			return errShuttingDown
+		}
+		if s.maxConns > 0 && len(s.activeConn) >= s.maxConns {
+			s.connStats.rejected.Add(1)
+			logger.Warn("rpc server: too many connections, reject", "remote", sc.peer.RemoteAddr)
+			return errTooManyConns
+		}
+		s.activeConn[sc] = struct{}{}
+	} else {
+		delete(s.activeConn, sc)
+	}
+	return nil
+}
+
+func (s *Server) trackListener(lis net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.inShutdown.Load() {
+			return false
+		}
+		s.listeners[lis] = struct{}{}
+	} else {
+		delete(s.listeners, lis)
+	}
+	return true
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for lis := range s.listeners {
+		if cerr := lis.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, lis)
+	}
+	return err
+}
+
+// 关闭没有正在处理请求的连接，返回是否所有连接都已关闭
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	quiescent := true
+	for sc := range s.activeConn {
+		if atomic.LoadInt64(&sc.active) != 0 {
+			quiescent = false
+			continue
+		}
+		_ = sc.rwc.Close()
+		delete(s.activeConn, sc)
+	}
+	return quiescent
+}
+
+// Shutdown 优雅关闭服务：停止接收新连接，通知客户端不再发起新请求，
+// 等待正在处理的请求完成后关闭连接。ctx 结束时强制关闭所有连接并返回 ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown.Store(true)
+	lnErr := s.closeListenersLocked()
+	conns := make([]*serverConn, 0, len(s.activeConn))
+	for sc := range s.activeConn {
+		if sc.cc != nil {
+			conns = append(conns, sc)
+		}
+	}
+	s.mu.Unlock()
+	// 每个连接单独发送：客户端不读取时写入会阻塞，不能影响其他连接和 ctx 超时，连接关闭后写入返回
+	for _, sc := range conns {
+		go s.goAway(sc)
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			if pool := s.pool.Swap(nil); pool != nil {
+				pool.stop()
+			}
+			return lnErr
+		}
+		select {
+		case <-ctx.Done():
+			_ = s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close 立即关闭服务：关闭所有监听和连接，不等待正在处理的请求
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inShutdown.Store(true)
+	err := s.closeListenersLocked()
+	for sc := range s.activeConn {
+		_ = sc.rwc.Close()
+		delete(s.activeConn, sc)
+	}
+	if pool := s.pool.Swap(nil); pool != nil {
+		pool.stop()
+	}
+	return err
+}
+
 // ServeConn 一次连接可以包含多次调用，报文格式：| Option | Header1 | Body1 | Header2 | Body2 | ...
 func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	s.serveConn(conn, "")
+}
+
+func (s *Server) serveConn(conn io.ReadWriteCloser, transport string) {
 	defer func() {
 		_ = conn.Close()
 	}()
+	sc := &serverConn{rwc: conn, peer: newPeer(s.nextConnID.Add(1), conn, transport), since: time.Now()}
+	sc.reverse = newReverseCaller(sc)
+	sc.peer.reverse = sc.reverse
+	sc.ctx, sc.cancel = context.WithCancel(context.WithValue(context.Background(), peerKey{}, sc.peer))
+	defer sc.cancel()
+	s.mu.Lock()
+	timeouts := s.timeouts
+	s.mu.Unlock()
+	dc, hasDeadline := conn.(deadlineConn)
+	if err := s.trackConn(sc, true); err != nil {
+		if hasDeadline {
+			rejectConn(dc, conn, timeouts.handshake, err)
+		}
+		return
+	}
+	defer s.trackConn(sc, false)
+	if hasDeadline && timeouts.handshake > 0 {
+		_ = dc.SetDeadline(time.Now().Add(timeouts.handshake))
+	}
 	// 反序列化 Option，检查
 	var opt option.Option
-	switch option.OptCodecType {
-	case common.OptionCodecBinary:
-		if err := binary.Read(conn, binary.BigEndian, &opt); err != nil {
-			log.Println("rpc server: options error: ", err)
-			return
-		}
-	case common.OptionCodecJson:
-		if err := json.NewDecoder(conn).Decode(&opt); err != nil {
-			log.Println("rpc server: options error: ", err)
-			return
+	hs, err := option.Read(conn, &opt)
+	if err != nil {
+		s.handshakeError(err)
+		logger.Warn("rpc server: options error", "remote", sc.peer.RemoteAddr, "err", err)
+		if hs != nil {
+			_ = option.WriteReply(conn, hs, "options error: "+err.Error())
 		}
+		return
 	}
 	if opt.MagicNumber != option.MagicNumber {
-		log.Printf("rpc server: invalid magic number: %v", opt.MagicNumber)
+		logger.Warn("rpc server: invalid magic number", "remote", sc.peer.RemoteAddr, "magic", opt.MagicNumber)
+		_ = option.WriteReply(conn, hs, fmt.Sprintf("invalid magic number: %v", opt.MagicNumber))
 		return
 	}
 	// 根据 CodeType 选择解码器进行解码
 	codecFunc, ok := codec.NewCodecFuncMap[opt.CodecType]
 	if !ok {
-		log.Printf("rpc server: invalid codec type: %v", opt.CodecType)
+		logger.Warn("rpc server: invalid codec type", "remote", sc.peer.RemoteAddr, "codec", opt.CodecType)
+		_ = option.WriteReply(conn, hs, fmt.Sprintf("invalid codec type: %v", opt.CodecType))
+		return
+	}
+	hs.Capabilities = opt.Capabilities & s.capabilities()
+	sc.peer.Capabilities = hs.Capabilities
+	if err = option.WriteReply(conn, hs, ""); err != nil {
+		s.handshakeError(err)
+		logger.Warn("rpc server: options error", "remote", sc.peer.RemoteAddr, "err", err)
 		return
 	}
-	s.serveCodec(codecFunc(conn), &opt)
+	sc.peer.handshakeDone(conn, &opt)
+	var rwc io.ReadWriteCloser = conn
+	if sc.tc = newTimeoutConn(conn, timeouts); sc.tc != nil {
+		rwc = sc.tc
+	}
+	sc.counter = newCountingConn(rwc)
+	cc := codecFunc(sc.counter)
+	if len(s.authenticators) > 0 {
+		principal, err := auth.Serve(sc.ctx, auth.NewCodecConn(cc), s.authenticators)
+		if err != nil {
+			s.handshakeError(err)
+			logger.Warn("rpc server: authentication failed", "remote", sc.peer.RemoteAddr, "err", err)
+			return
+		}
+		sc.peer.Principal = principal
+	}
+	if hasDeadline && timeouts.handshake > 0 {
+		_ = dc.SetDeadline(time.Time{})
+	}
+	s.mu.Lock()
+	sc.cc = cc
+	s.mu.Unlock()
+	s.serveCodec(sc, &opt)
 }
 
-// Accept 直接使用 TCP 协议
+// Accept 直接使用 TCP 协议。调用 Shutdown/Close 后返回
 func (s *Server) Accept(lis net.Listener) {
+	if !s.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer s.trackListener(lis, false)
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server accept error: ", err)
+			if !s.inShutdown.Load() {
+				logger.Error("rpc server: accept error", "err", err)
+			}
 			return
 		}
 		go s.ServeConn(conn)
@@ -211,11 +722,11 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
-		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		logger.Warn("rpc server: hijacking error", "remote", req.RemoteAddr, "err", err)
 		return
 	}
 	_, _ = io.WriteString(conn, "HTTP/1.0 "+common.Connected+"\n\n")
-	s.ServeConn(conn)
+	s.serveConn(conn, "http")
 }
 
 // HandleHTTP 使用 HTTP 协议
@@ -223,29 +734,169 @@ func (s *Server) HandleHTTP() *http.ServeMux {
 	httpServer := http.NewServeMux()
 	httpServer.Handle(common.DefaultRPCPath, s)
 	httpServer.Handle(common.DefaultDebugPath, debugHTTP{s})
-	log.Println("rpc server debug path:", common.DefaultDebugPath)
+	httpServer.Handle(common.DefaultDebugJSONPath, debugJSON{s})
+	httpServer.Handle(common.DefaultMetricsPath, metrics.Handler(s.metrics.registry, metrics.Default))
+	logger.Info("rpc server: debug path", "path", common.DefaultDebugPath)
 	return httpServer
 }
 
-// Register 将服务注册为 Service 实例，对外支持 RPC 调用
-func (s *Server) Register(obj interface{}) error {
-	serviceObj := newService(obj)
+// Register 将服务注册为 Service 实例，对外支持 RPC 调用。服务名为类型名，opts 用于指定方法的超时等配置
+func (s *Server) Register(obj interface{}, opts ...*option.MethodOption) error {
+	return s.register(obj, "", opts...)
+}
+
+// RegisterName 使用指定的服务名注册服务。name 可以带版本标签，如 "Arith@v2"，
+// 客户端通过 "Arith@v2.Add" 调用对应版本，同一服务的多个版本可以同时注册
+func (s *Server) RegisterName(name string, obj interface{}, opts ...*option.MethodOption) error {
+	if name == "" {
+		return errors.New("rpc server: service name is empty")
+	}
+	return s.register(obj, name, opts...)
+}
+
+func (s *Server) register(obj interface{}, name string, opts ...*option.MethodOption) error {
+	serviceObj, err := newService(obj, name)
+	if err != nil {
+		return err
+	}
+	if err := serviceObj.applyOptions(opts...); err != nil {
+		return err
+	}
 	if _, dup := s.serviceMap.LoadOrStore(serviceObj.name, serviceObj); dup {
 		return errors.New("rpc: service already registered: " + serviceObj.name)
 	}
 	return nil
 }
 
+// Unregister 注销服务，新的请求将找不到该服务，正在处理的请求不受影响
+func (s *Server) Unregister(name string) error {
+	svcInter, ok := s.serviceMap.LoadAndDelete(name)
+	if !ok {
+		return errors.New("rpc server: can't find service " + name)
+	}
+	s.retire(svcInter.(*service))
+	logger.Info("rpc server: unregister", "service", name)
+	return nil
+}
+
+// Replace 原子地替换已注册的服务实现。替换后新的请求由 obj 处理，
+// 旧实现上正在处理的请求会继续完成。通过 SetMethodConcurrency 设置的配置不会保留，需要通过 opts 重新指定
+func (s *Server) Replace(name string, obj interface{}, opts ...*option.MethodOption) error {
+	serviceObj, err := newService(obj, name)
+	if err != nil {
+		return err
+	}
+	if err = serviceObj.applyOptions(opts...); err != nil {
+		return err
+	}
+	for {
+		old, ok := s.serviceMap.Load(name)
+		if !ok {
+			return errors.New("rpc server: can't find service " + name)
+		}
+		if s.serviceMap.CompareAndSwap(name, old, serviceObj) {
+			s.retire(old.(*service))
+			logger.Info("rpc server: replace", "service", name)
+			return nil
+		}
+	}
+}
+
+// RegisterFunc 将函数或闭包注册为 RPC 方法，serviceMethod 格式为 "Service.Method"。
+// fn 的签名与结构体方法相同：func(args, reply) error 或 func(ctx, args, reply) error。
+// 同一个服务名下可以注册多个函数，但不能与 Register 注册的服务重名
+func (s *Server) RegisterFunc(serviceMethod string, fn interface{}, opts ...*option.MethodOption) error {
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot < 0 {
+		return errors.New("rpc server: service/method ill-formed: " + serviceMethod)
+	}
+	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
+	for {
+		var old *service
+		oldInter, loaded := s.serviceMap.Load(serviceName)
+		if loaded {
+			old = oldInter.(*service)
+		}
+		serviceObj, err := newFuncService(old, serviceName, methodName, fn)
+		if err != nil {
+			return err
+		}
+		for _, opt := range orderOptions(opts) {
+			if opt.Method != "" && opt.Method != methodName {
+				return fmt.Errorf("rpc server: option for method %s doesn't match %s", opt.Method, serviceMethod)
+			}
+			if err := serviceObj.method[methodName].applyOption(opt); err != nil {
+				return fmt.Errorf("rpc server: %s: %w", serviceMethod, err)
+			}
+		}
+		if !loaded {
+			if _, dup := s.serviceMap.LoadOrStore(serviceName, serviceObj); !dup {
+				return nil
+			}
+		} else if s.serviceMap.CompareAndSwap(serviceName, old, serviceObj) {
+			return nil
+		}
+	}
+}
+
+// 记录被注销或替换的服务，直到其正在处理的请求全部完成，用于 debug 页面展示
+func (s *Server) retire(svc *service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneRetiredLocked()
+	if svc.running() > 0 {
+		s.retired = append(s.retired, svc)
+	}
+}
+
+func (s *Server) pruneRetiredLocked() {
+	alive := s.retired[:0]
+	for _, svc := range s.retired {
+		if svc.running() > 0 {
+			alive = append(alive, svc)
+		}
+	}
+	s.retired = alive
+}
+
+// 返回仍有请求在处理的旧服务
+func (s *Server) retiredServices() []*service {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneRetiredLocked()
+	return append([]*service(nil), s.retired...)
+}
+
 var DefaultServer = NewServer()
 
 func Accept(lis net.Listener) {
 	DefaultServer.Accept(lis)
 }
 
+func AcceptTLS(lis net.Listener, config *tls.Config) {
+	DefaultServer.AcceptTLS(lis, config)
+}
+
 func HandleHTTP() {
 	DefaultServer.HandleHTTP()
 }
 
-func Register(obj interface{}) error {
-	return DefaultServer.Register(obj)
+func Register(obj interface{}, opts ...*option.MethodOption) error {
+	return DefaultServer.Register(obj, opts...)
+}
+
+func Unregister(name string) error {
+	return DefaultServer.Unregister(name)
+}
+
+func Replace(name string, obj interface{}, opts ...*option.MethodOption) error {
+	return DefaultServer.Replace(name, obj, opts...)
+}
+
+func RegisterFunc(serviceMethod string, fn interface{}, opts ...*option.MethodOption) error {
+	return DefaultServer.RegisterFunc(serviceMethod, fn, opts...)
+}
+
+func RegisterName(name string, obj interface{}, opts ...*option.MethodOption) error {
+	return DefaultServer.RegisterName(name, obj, opts...)
 }
@@ -0,0 +1,881 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/felixorbit/fexrpc/auth"
+	"github.com/felixorbit/fexrpc/codec"
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/option"
+)
+
+func TestServer_handleTimeout(t *testing.T) {
+	s := NewServer()
+	var arith Arith
+	_ = s.Register(arith, &option.MethodOption{Method: "Div", Timeout: time.Second, MaxTimeout: time.Second * 2})
+	s.SetTimeouts(time.Second*3, time.Second*5)
+	_, sum, _ := s.findService("Arith.Sum")
+	_, div, _ := s.findService("Arith.Div")
+
+	cases := []struct {
+		mtype     *methodType
+		requested time.Duration
+		timeout   time.Duration
+		source    string
+	}{
+		{sum, 0, time.Second * 3, "server default timeout"},
+		{sum, time.Second, time.Second, "client timeout"},
+		{sum, time.Minute, time.Second * 5, "server max timeout"},
+		{div, 0, time.Second, "method default timeout"},
+		{div, time.Minute, time.Second * 2, "method max timeout"},
+	}
+	for _, c := range cases {
+		timeout, source := s.handleTimeout(c.mtype, c.requested)
+		_assert(timeout == c.timeout && source == c.source,
+			"expect %s (%s), but got %s (%s)", c.timeout, c.source, timeout, source)
+	}
+
+	s.SetTimeouts(0, time.Second*5)
+	timeout, source := s.handleTimeout(sum, 0)
+	_assert(timeout == time.Second*5 && source == "server max timeout", "client can't disable timeout when max is set")
+}
+
+func TestServer_MergeMethodOptions(t *testing.T) {
+	s := NewServer()
+	var arith Arith
+	err := s.Register(arith,
+		&option.MethodOption{Method: "Div", MaxTimeout: time.Second * 5},
+		&option.MethodOption{Timeout: time.Second},
+	)
+	_assert(err == nil, "register failed: %v", err)
+	_, sum, _ := s.findService("Arith.Sum")
+	_, div, _ := s.findService("Arith.Div")
+	_assert(sum.timeout == time.Second && sum.maxTimeout == 0, "expect service-wide timeout, but got %s/%s", sum.timeout, sum.maxTimeout)
+	_assert(div.timeout == time.Second && div.maxTimeout == time.Second*5,
+		"method option should refine service-wide option, but got %s/%s", div.timeout, div.maxTimeout)
+}
+
+func TestServer_RegisterUnknownMethodOption(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	err := s.Register(foo, &option.MethodOption{Method: "Mul", Timeout: time.Second})
+	_assert(err != nil, "expect error for unknown method")
+}
+
+// 通过 net.Pipe 建立一次连接，完成 Option 协商后返回编解码器
+func dialPipe(s *Server, opt *option.Option) codec.Codec {
+	cliConn, srvConn := net.Pipe()
+	go s.ServeConn(srvConn)
+	_, _ = option.Negotiate(cliConn, opt)
+	return codec.NewGobCodec(cliConn)
+}
+
+func TestServer_ExactlyOnceResponse(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	var sleeper Sleeper
+	_ = s.Register(foo)
+	_ = s.Register(sleeper)
+	_, mtype, _ := s.findService("Foo.Sum")
+	cc := dialPipe(s, &option.Option{
+		MagicNumber:   option.MagicNumber,
+		CodecType:     codec.GobType,
+		HandleTimeout: time.Millisecond * 100,
+	})
+	defer func() { _ = cc.Close() }()
+
+	// Sleeper.Wait 会在 context 取消后返回，此时结果应被丢弃
+	_, wait, _ := s.findService("Sleeper.Wait")
+	_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.Wait", Seq: 1}, 1000)
+	var h codec.Header
+	_ = cc.ReadHeader(&h)
+	_ = cc.ReadBody(nil)
+	_assert(h.Seq == 1 && h.Code == common.CodeDeadlineExceeded, "expect a timeout response, but got %+v", h)
+
+	// 下一个响应必须属于新的请求
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, Args{Num1: 1, Num2: 2})
+	h = codec.Header{}
+	var reply int
+	_ = cc.ReadHeader(&h)
+	_ = cc.ReadBody(&reply)
+	_assert(h.Seq == 2 && reply == 3, "expect response of seq 2, but got %+v", h)
+	_assert(mtype.NumCalls() == 1, "Foo.Sum should be called once")
+	_assert(wait.NumLate() == 1, "late result should be counted, but got %d", wait.NumLate())
+}
+
+type fooV2 int
+
+func (f fooV2) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2 + 100
+	return nil
+}
+
+func TestServer_RegisterName(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	var v2 fooV2
+	_assert(s.Register(foo) == nil, "register Foo failed")
+	_assert(s.RegisterName("Foo@v2", v2) == nil, "register Foo@v2 failed")
+	_assert(s.Register(v2) != nil, "expect error for unexported type")
+	_assert(s.RegisterName("Foo@v2", foo) != nil, "expect error for duplicate service")
+	for _, name := range []string{"Foo.Bar", "@v2", "Foo@", "Foo@v2@v3"} {
+		_assert(s.RegisterName(name, foo) != nil, "expect error for invalid name %q", name)
+	}
+
+	svc, mtype, err := s.findService("Foo@v2.Sum")
+	_assert(err == nil && svc.name == "Foo@v2" && mtype != nil, "expect to route Foo@v2.Sum, but got %v", err)
+	svc, _, err = s.findService("Foo.Sum")
+	_assert(err == nil && svc.name == "Foo", "expect to route Foo.Sum, but got %v", err)
+}
+
+func TestServer_ReplaceAndUnregister(t *testing.T) {
+	s := NewServer()
+	var sleeper Sleeper
+	var v2 fooV2
+	_ = s.RegisterName("Foo", sleeper)
+	cc := dialPipe(s, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType})
+	defer func() { _ = cc.Close() }()
+
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Wait", Seq: 1}, 200)
+	time.Sleep(time.Millisecond * 50)
+	_assert(s.Replace("Foo", v2) == nil, "replace Foo failed")
+	_assert(len(s.retiredServices()) == 1, "old implementation should be retired with calls in flight")
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, Args{Num1: 1, Num2: 2})
+
+	replies := make(map[uint64]int)
+	for i := 0; i < 2; i++ {
+		var h codec.Header
+		var reply int
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(&reply)
+		_assert(h.Error == "", "unexpected error: %s", h.Error)
+		replies[h.Seq] = reply
+	}
+	_assert(replies[1] == 200, "in-flight call on old implementation should finish, but got %d", replies[1])
+	_assert(replies[2] == 103, "new call should go to new implementation, but got %d", replies[2])
+	// 响应发送后才释放计数，稍等片刻
+	for i := 0; i < 100 && len(s.retiredServices()) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(len(s.retiredServices()) == 0, "retired service should be pruned after calls finished")
+
+	_assert(s.Unregister("Foo") == nil, "unregister Foo failed")
+	_assert(s.Unregister("Foo") != nil, "expect error when unregistering twice")
+	_assert(s.Replace("Foo", v2) != nil, "expect error when replacing a missing service")
+	_, _, err := s.findService("Foo.Sum")
+	_assert(err != nil, "Foo should be unregistered")
+}
+
+func TestServer_RegisterFunc(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	_ = s.Register(foo)
+	base := 10
+	add := func(args Args, reply *int) error {
+		*reply = args.Num1 + args.Num2 + base
+		return nil
+	}
+	_assert(s.RegisterFunc("Math.Add", add) == nil, "register Math.Add failed")
+	_assert(s.RegisterFunc("Math.Mul", func(ctx context.Context, args Args, reply *int) error {
+		*reply = args.Num1 * args.Num2
+		return nil
+	}, &option.MethodOption{Timeout: time.Second}) == nil, "register Math.Mul failed")
+	_assert(s.RegisterFunc("Math.Add", add) != nil, "expect error for duplicate method")
+	_assert(s.RegisterFunc("Foo.Add", add) != nil, "expect error for conflict with struct service")
+	_assert(s.RegisterFunc("Math.Bad", func(args Args) error { return nil }) != nil, "expect error for invalid signature")
+	_assert(s.RegisterFunc("Math.Val", func(args Args, reply int) error { return nil }) != nil, "expect error for non-pointer reply")
+	_assert(s.RegisterFunc("Math.add", add) != nil, "expect error for unexported method name")
+	_assert(s.RegisterFunc("Math", add) != nil, "expect error for ill-formed name")
+
+	svc, add1, err := s.findService("Math.Add")
+	_assert(err == nil, "expect to find Math.Add, but got %v", err)
+	_, mul, _ := s.findService("Math.Mul")
+	_assert(mul.WithContext && mul.timeout == time.Second, "Math.Mul should accept context and options")
+	argv, replyv := add1.NewArgv(), add1.NewReplyv()
+	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 2}))
+	err = svc.call(context.Background(), add1, argv, replyv)
+	_assert(err == nil && *replyv.Interface().(*int) == 13 && add1.NumCalls() == 1, "failed to call function")
+}
+
+type sessionReply struct {
+	ConnID    uint64
+	Transport string
+	Count     int
+}
+
+func TestServer_PeerSession(t *testing.T) {
+	s := NewServer()
+	_ = s.RegisterFunc("Session.Count", func(ctx context.Context, _ int, reply *sessionReply) error {
+		p, ok := PeerFromContext(ctx)
+		if !ok {
+			return errors.New("no peer in context")
+		}
+		count, _ := p.Get("count")
+		n, _ := count.(int)
+		p.Set("count", n+1)
+		*reply = sessionReply{ConnID: p.ID, Transport: p.Transport, Count: n + 1}
+		return nil
+	})
+	call := func(cc codec.Codec, seq uint64) sessionReply {
+		var h codec.Header
+		var reply sessionReply
+		_ = cc.Write(&codec.Header{ServiceMethod: "Session.Count", Seq: seq}, 0)
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(&reply)
+		_assert(h.Error == "", "unexpected error: %s", h.Error)
+		return reply
+	}
+	opt := &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType}
+	cc1, cc2 := dialPipe(s, opt), dialPipe(s, opt)
+	defer func() {
+		_ = cc1.Close()
+		_ = cc2.Close()
+	}()
+
+	r1, r2, r3 := call(cc1, 1), call(cc1, 2), call(cc2, 1)
+	_assert(r1.Transport == "pipe", "expect pipe transport, but got %s", r1.Transport)
+	_assert(r1.ConnID == r2.ConnID && r1.ConnID != r3.ConnID, "connection IDs mismatch")
+	_assert(r1.Count == 1 && r2.Count == 2 && r3.Count == 1, "session state should be per connection")
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fexrpc.sock")
+	// 模拟上次运行残留的 socket 文件
+	stale, err := net.Listen("unix", path)
+	_assert(err == nil, "listen failed: %v", err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	l, err := ListenUnix(path)
+	_assert(err == nil, "stale socket file should be removed, but got %v", err)
+	_, err = ListenUnix(path)
+	_assert(err != nil, "expect error when socket is in use")
+	_ = l.Close()
+	_, err = os.Stat(path)
+	_assert(os.IsNotExist(err), "socket file should be removed on close")
+
+	file := filepath.Join(t.TempDir(), "file")
+	_ = os.WriteFile(file, nil, 0600)
+	_, err = ListenUnix(file)
+	_assert(err != nil, "expect error for non-socket file")
+}
+
+func TestACL_allow(t *testing.T) {
+	acl := &ACL{Rules: []ACLRule{
+		{Roles: []string{"admin"}, Methods: []string{"*"}},
+		{Principals: []string{"*"}, Methods: []string{"Foo.Sum", "Foo.Get*"}},
+		{Principals: []string{"svc-a"}, Methods: []string{"Admin.Stats"}},
+		{Anonymous: true, Methods: []string{"Health.*"}},
+	}}
+	admin := &Peer{Principal: &auth.Principal{Name: "root", Roles: []string{"admin"}}}
+	user := &Peer{Principal: &auth.Principal{Name: "alice"}}
+	svc := &Peer{TLSIdentity: "svc-a"}
+	anonymous := &Peer{}
+	cases := []struct {
+		peer   *Peer
+		method string
+		allow  bool
+	}{
+		{admin, "Admin.Reset", true},
+		{user, "Foo.Sum", true},
+		{user, "Foo.GetName", true},
+		{user, "Admin.Reset", false},
+		{svc, "Admin.Stats", true},
+		{svc, "Admin.Reset", false},
+		{anonymous, "Health.Check", true},
+		{anonymous, "Foo.Sum", false},
+	}
+	for _, c := range cases {
+		_assert(acl.allow(c.peer, c.method) == c.allow, "%s: expect allow=%v", c.method, c.allow)
+	}
+}
+
+func TestServer_ACLDenied(t *testing.T) {
+	s := NewServer()
+	var arith Arith
+	_ = s.Register(arith)
+	s.SetAuthenticators(auth.NewTokenAuthenticator(map[string]*auth.Principal{"secret": {Name: "alice"}}))
+	s.SetACL(&ACL{Rules: []ACLRule{{Principals: []string{"alice"}, Methods: []string{"Arith.Sum"}}}})
+	cc := dialPipe(s, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType})
+	defer func() { _ = cc.Close() }()
+	_assert(auth.Handshake(auth.NewCodecConn(cc), auth.TokenCredentials("secret")) == nil, "auth failed")
+
+	_, div, _ := s.findService("Arith.Div")
+	var h codec.Header
+	_ = cc.Write(&codec.Header{ServiceMethod: "Arith.Div", Seq: 1}, Args{Num1: 1, Num2: 0})
+	_ = cc.ReadHeader(&h)
+	_ = cc.ReadBody(nil)
+	_assert(h.Code == common.CodePermissionDenied, "expect permission denied, but got %+v", h)
+	_assert(div.NumCalls() == 0, "denied method shouldn't be called")
+
+	var missing codec.Header
+	_ = cc.Write(&codec.Header{ServiceMethod: "Arith.Missing", Seq: 2}, Args{})
+	_ = cc.ReadHeader(&missing)
+	_ = cc.ReadBody(nil)
+	_assert(missing.Code == h.Code && missing.Error == strings.Replace(h.Error, "Arith.Div", "Arith.Missing", 1),
+		"denial shouldn't reveal whether the method exists, but got %+v", missing)
+
+	var reply int
+	h = codec.Header{}
+	_ = cc.Write(&codec.Header{ServiceMethod: "Arith.Sum", Seq: 3}, Args{Num1: 1, Num2: 2})
+	_ = cc.ReadHeader(&h)
+	_ = cc.ReadBody(&reply)
+	_assert(h.Error == "" && reply == 3, "expect allowed call, but got %+v", h)
+
+	s.SetACL(nil)
+	h = codec.Header{}
+	_ = cc.Write(&codec.Header{ServiceMethod: "Arith.Div", Seq: 4}, Args{Num1: 4, Num2: 2})
+	_ = cc.ReadHeader(&h)
+	_ = cc.ReadBody(&reply)
+	_assert(h.Error == "" && reply == 2, "ACL should be updatable at runtime, but got %+v", h)
+}
+
+func TestTokenBucket(t *testing.T) {
+	limit := &RateLimit{Rate: 10, Burst: 2}
+	now := time.Now()
+	b := &tokenBucket{tokens: 2, last: now}
+	ok1, _ := b.take(now, limit)
+	ok2, _ := b.take(now, limit)
+	ok3, wait := b.take(now, limit)
+	_assert(ok1 && ok2 && !ok3, "expect burst of 2")
+	_assert(wait > 0 && wait <= 100*time.Millisecond, "expect retry after about 100ms, but got %s", wait)
+	ok4, _ := b.take(now.Add(100*time.Millisecond), limit)
+	_assert(ok4, "expect token refilled")
+}
+
+func TestRateLimiter_Buckets(t *testing.T) {
+	r := &rateLimiter{
+		limits:  []RateLimit{{Key: LimitByIdentity, Rate: 1, Burst: 1}},
+		buckets: make(map[string]*tokenBucket),
+	}
+	now := time.Now()
+	a := &Peer{RemoteAddr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}}
+	b := &Peer{RemoteAddr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}}
+	okA, _ := r.allow(a, "Foo.Sum", now)
+	okB, _ := r.allow(b, "Foo.Sum", now)
+	_assert(okA && okB, "anonymous peers with different IPs shouldn't share a bucket")
+	okA, _ = r.allow(a, "Foo.Sum", now)
+	_assert(!okA, "expect anonymous peer limited by its IP")
+
+	for i := 0; i <= maxIdleBuckets; i++ {
+		r.buckets[fmt.Sprint("idle", i)] = &tokenBucket{tokens: 1, last: now, limit: &r.limits[0]}
+	}
+	r.allow(a, "Foo.Sum", now)
+	_assert(len(r.buckets) == 2, "expect full buckets swept, but got %d", len(r.buckets))
+	for i := 0; i <= maxIdleBuckets; i++ {
+		r.buckets[fmt.Sprint("idle", i)] = &tokenBucket{tokens: 1, last: now, limit: &r.limits[0]}
+	}
+	r.allow(a, "Foo.Sum", now.Add(sweepInterval/2))
+	_assert(len(r.buckets) > maxIdleBuckets, "expect sweeps throttled, but got %d buckets", len(r.buckets))
+	r.allow(a, "Foo.Sum", now.Add(sweepInterval))
+	_assert(len(r.buckets) == 1, "expect buckets swept after interval, but got %d", len(r.buckets))
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	s := NewServer()
+	var arith Arith
+	_ = s.Register(arith)
+	s.SetRateLimits(RateLimit{Key: LimitByIP | LimitByMethod, Methods: []string{"Arith.Sum"}, Rate: 1, Burst: 1})
+	cc := dialPipe(s, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType, Capabilities: option.CapMetadata})
+	defer func() { _ = cc.Close() }()
+
+	call := func(method string, seq uint64) codec.Header {
+		var h codec.Header
+		var reply int
+		_ = cc.Write(&codec.Header{ServiceMethod: method, Seq: seq}, Args{Num1: 4, Num2: 2})
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(&reply)
+		return h
+	}
+	h := call("Arith.Sum", 1)
+	_assert(h.Error == "", "first call should pass, but got %+v", h)
+	h = call("Arith.Sum", 2)
+	_assert(h.Code == common.CodeResourceExhausted, "expect resource exhausted, but got %+v", h)
+	retryAfter, err := time.ParseDuration(h.Meta[common.MetaRetryAfter])
+	_assert(err == nil && retryAfter > 0, "expect retry-after hint, but got %+v", h.Meta)
+	h = call("Arith.Div", 3)
+	_assert(h.Error == "", "other methods shouldn't be limited, but got %+v", h)
+
+	s.SetRateLimits()
+	h = call("Arith.Sum", 4)
+	_assert(h.Error == "", "rate limits should be updatable at runtime, but got %+v", h)
+}
+
+// 等待服务端关闭连接
+func waitClosed(conn net.Conn, timeout time.Duration) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := conn.Read(make([]byte, 1))
+	return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestServer_ConnTimeouts(t *testing.T) {
+	s := NewServer()
+	var sleeper Sleeper
+	_ = s.Register(sleeper)
+	s.SetConnTimeouts(time.Millisecond*50, time.Millisecond*50, time.Millisecond*200)
+	opt := &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType}
+
+	t.Run("handshake", func(t *testing.T) {
+		cliConn, srvConn := net.Pipe()
+		go s.ServeConn(srvConn)
+		_assert(waitClosed(cliConn, time.Second), "connection without handshake should be closed")
+		_assert(s.connStats.handshakeTimeouts.Load() == 1, "expect 1 handshake timeout")
+	})
+	t.Run("read", func(t *testing.T) {
+		cliConn, srvConn := net.Pipe()
+		go s.ServeConn(srvConn)
+		_, _ = option.Negotiate(cliConn, opt)
+		_, _ = cliConn.Write([]byte{0x20})
+		_assert(waitClosed(cliConn, time.Second), "connection with partial message should be closed")
+		_assert(s.connStats.readTimeouts.Load() == 1, "expect 1 read timeout")
+	})
+	t.Run("idle", func(t *testing.T) {
+		cc := dialPipe(s, opt)
+		defer func() { _ = cc.Close() }()
+		// 处理中的请求不受 idle 超时限制
+		var h codec.Header
+		var reply int
+		_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.Wait", Seq: 1}, 300)
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(&reply)
+		_assert(h.Error == "" && reply == 300, "busy connection shouldn't be closed, but got %+v", h)
+		start := time.Now()
+		err := cc.ReadHeader(&h)
+		_assert(err != nil && time.Since(start) < time.Second, "idle connection should be closed")
+		_assert(s.connStats.idleClosed.Load() == 1, "expect 1 idle connection closed")
+	})
+}
+
+func TestServer_MaxConns(t *testing.T) {
+	s := NewServer()
+	s.SetMaxConns(1)
+	cliConn1, srvConn1 := net.Pipe()
+	go s.ServeConn(srvConn1)
+	defer func() { _ = cliConn1.Close() }()
+	for i := 0; i < 100 && s.debugConns().Active == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	cliConn2, srvConn2 := net.Pipe()
+	go s.ServeConn(srvConn2)
+	_, err := option.Negotiate(cliConn2, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType})
+	_assert(errors.Is(err, option.ErrRejected), "expect rejection reply, but got %v", err)
+	_assert(waitClosed(cliConn2, time.Second), "connection over the limit should be closed")
+	_assert(s.debugConns().Rejected == 1, "expect 1 rejected connection")
+}
+
+func TestServer_Handshake(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	_ = s.Register(foo)
+	opt := &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType}
+	callSum := func(cc codec.Codec) int {
+		var h codec.Header
+		var reply int
+		_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, Args{Num1: 1, Num2: 2})
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(&reply)
+		return reply
+	}
+
+	t.Run("json", func(t *testing.T) {
+		option.OptCodecType = common.OptionCodecJson
+		defer func() { option.OptCodecType = common.OptionCodecBinary }()
+		cliConn, srvConn := net.Pipe()
+		go s.ServeConn(srvConn)
+		_, err := option.Negotiate(cliConn, opt)
+		_assert(err == nil, "json option should be accepted, but got %v", err)
+		_assert(callSum(codec.NewGobCodec(cliConn)) == 3, "failed to call after json handshake")
+	})
+	t.Run("legacy", func(t *testing.T) {
+		cliConn, srvConn := net.Pipe()
+		go s.ServeConn(srvConn)
+		_ = json.NewEncoder(cliConn).Encode(opt)
+		_assert(callSum(codec.NewGobCodec(cliConn)) == 3, "failed to call after legacy json handshake")
+	})
+	t.Run("reject", func(t *testing.T) {
+		cliConn, srvConn := net.Pipe()
+		go s.ServeConn(srvConn)
+		_, err := option.Negotiate(cliConn, &option.Option{MagicNumber: 1, CodecType: codec.GobType})
+		_assert(errors.Is(err, option.ErrRejected) && !errors.Is(err, option.ErrUnsupportedVersion),
+			"expect rejection for magic number, but got %v", err)
+		cliConn, srvConn = net.Pipe()
+		go s.ServeConn(srvConn)
+		go func() { _, _ = cliConn.Write([]byte{0x31}) }()
+		err = option.ReadReply(cliConn, &option.Handshake{Version: 3, Format: common.OptionCodecBinary})
+		_assert(errors.Is(err, option.ErrUnsupportedVersion), "expect rejection of unknown version, but got %v", err)
+	})
+}
+
+func TestServer_NegotiateCapabilities(t *testing.T) {
+	s := NewServer()
+	for _, c := range []struct {
+		version   int
+		requested option.Capability
+		agreed    option.Capability
+	}{
+		{0, option.CapCompression | option.CapMetadata | option.CapCancellation, option.CapMetadata | option.CapCancellation},
+		{1, option.DefaultCapabilities, 0},
+	} {
+		cliConn, srvConn := net.Pipe()
+		go s.ServeConn(srvConn)
+		hs, err := option.Negotiate(cliConn, &option.Option{
+			MagicNumber:     option.MagicNumber,
+			CodecType:       codec.GobType,
+			Capabilities:    c.requested,
+			ProtocolVersion: c.version,
+		})
+		_assert(err == nil && hs.Capabilities == c.agreed, "expect %s, but got %v %v", c.agreed, hs, err)
+		_ = cliConn.Close()
+	}
+}
+
+func TestServer_Idempotency(t *testing.T) {
+	s := NewServer()
+	var executed atomic.Int32
+	_ = s.RegisterFunc("Pay.Charge", func(amount int, reply *int) error {
+		time.Sleep(time.Millisecond * 100)
+		*reply = int(executed.Add(1)) * 1000
+		return nil
+	})
+	cc := dialPipe(s, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType, Capabilities: option.CapMetadata})
+	defer func() { _ = cc.Close() }()
+
+	charge := func(seq uint64, key string) {
+		_ = cc.Write(&codec.Header{ServiceMethod: "Pay.Charge", Seq: seq, Meta: map[string]string{common.MetaIdempotencyKey: key}}, 1)
+	}
+	read := func() (codec.Header, int) {
+		var h codec.Header
+		var reply int
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(&reply)
+		return h, reply
+	}
+	// 第二个请求在第一个执行中到达，等待第一个的结果
+	charge(1, "order-1")
+	charge(2, "order-1")
+	h1, r1 := read()
+	h2, r2 := read()
+	_assert(r1 == 1000 && r2 == 1000 && executed.Load() == 1, "duplicate should not execute again, got %d %d", r1, r2)
+	_assert(h1.Meta[common.MetaIdempotentReplay] == "true" || h2.Meta[common.MetaIdempotentReplay] == "true", "replayed response should be marked")
+
+	charge(3, "order-1")
+	_, r3 := read()
+	charge(4, "order-2")
+	_, r4 := read()
+	_assert(r3 == 1000 && r4 == 2000 && executed.Load() == 2, "expect stored result for order-1 and a new call for order-2, got %d %d", r3, r4)
+}
+
+func TestIdempotencyCache_evict(t *testing.T) {
+	c := newIdempotencyCache(time.Minute, 2)
+	now := time.Now()
+	for _, key := range []string{"a", "b"} {
+		e, _ := c.begin(key, now)
+		c.finish(e, nil, common.CodeOK, "")
+	}
+	_, leader := c.begin("a", now)
+	_assert(!leader, "a should be cached")
+	_, _ = c.begin("c", now)
+	_, leader = c.begin("a", now)
+	_assert(leader, "the oldest entry should be evicted when full")
+	_, leader = c.begin("b", now.Add(time.Hour))
+	_assert(leader, "expired entry should be evicted")
+}
+
+func TestServer_CacheableMethod(t *testing.T) {
+	s := NewServer()
+	executed := 0
+	_ = s.RegisterFunc("Geo.Lookup", func(id int, reply *string) error {
+		executed++
+		*reply = fmt.Sprintf("city-%d", id)
+		return nil
+	}, &option.MethodOption{CacheTTL: time.Minute})
+	cc := dialPipe(s, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType, Capabilities: option.CapMetadata})
+	defer func() { _ = cc.Close() }()
+
+	lookup := func(seq uint64, id int) (codec.Header, string) {
+		var h codec.Header
+		var reply string
+		_ = cc.Write(&codec.Header{ServiceMethod: "Geo.Lookup", Seq: seq}, id)
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(&reply)
+		return h, reply
+	}
+	h, reply := lookup(1, 1)
+	_assert(reply == "city-1" && h.Meta[common.MetaCacheTTL] == "1m0s", "expect cache hint, but got %+v", h)
+	h, reply = lookup(2, 1)
+	_assert(reply == "city-1" && executed == 1 && h.Meta[common.MetaCacheHit] == "true", "expect cached reply, but got %+v", h)
+	_, reply = lookup(3, 2)
+	_assert(reply == "city-2" && executed == 2, "different args should not hit cache")
+}
+
+func TestServer_CacheContextMethod(t *testing.T) {
+	s := NewServer()
+	err := s.RegisterFunc("Geo.Whoami", func(ctx context.Context, id int, reply *string) error {
+		return nil
+	}, &option.MethodOption{CacheTTL: time.Minute})
+	_assert(err != nil, "CacheTTL on context-taking function should be rejected")
+	var sleeper Sleeper
+	err = s.Register(sleeper, &option.MethodOption{Method: "Wait", CacheTTL: time.Minute})
+	_assert(err != nil, "CacheTTL on context-taking method should be rejected")
+	err = s.Register(sleeper, &option.MethodOption{CacheTTL: time.Minute})
+	_assert(err == nil, "service-wide CacheTTL should skip context-taking methods, but got %v", err)
+	_, wait, _ := s.findService("Sleeper.Wait")
+	_assert(wait.cache == nil, "context-taking method shouldn't be cached")
+}
+
+func TestServer_CacheKeepsServiceTimeouts(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	err := s.Register(foo,
+		&option.MethodOption{Timeout: time.Second, MaxTimeout: time.Second * 2},
+		&option.MethodOption{Method: "Sum", CacheTTL: time.Minute},
+	)
+	_assert(err == nil, "register failed: %v", err)
+	_, sum, _ := s.findService("Foo.Sum")
+	_assert(sum.timeout == time.Second && sum.maxTimeout == time.Second*2 && sum.cacheTTL == time.Minute,
+		"per-method CacheTTL shouldn't reset service-wide timeouts, but got %s/%s/%s", sum.timeout, sum.maxTimeout, sum.cacheTTL)
+}
+
+// 记录访问日志的 Logger，每条日志的 key/value 发送到 ch
+type accessLogRecorder struct {
+	ch chan map[string]interface{}
+}
+
+func (r accessLogRecorder) Debug(string, ...interface{}) {}
+func (r accessLogRecorder) Warn(string, ...interface{})  {}
+func (r accessLogRecorder) Error(string, ...interface{}) {}
+func (r accessLogRecorder) Info(msg string, args ...interface{}) {
+	fields := map[string]interface{}{"msg": msg}
+	for i := 0; i+1 < len(args); i += 2 {
+		fields[args[i].(string)] = args[i+1]
+	}
+	r.ch <- fields
+}
+
+func TestServer_AccessLog(t *testing.T) {
+	type Login struct {
+		User     string
+		Password string
+		Card     struct{ Number, Holder string }
+	}
+	s := NewServer()
+	_ = s.RegisterFunc("User.Login", func(args Login, reply *bool) error {
+		*reply = true
+		return nil
+	})
+	rec := accessLogRecorder{ch: make(chan map[string]interface{}, 1)}
+	s.SetAccessLog(&AccessLog{Logger: rec, LogArgs: true, Redact: []RedactRule{
+		{Methods: []string{"User.*"}, Fields: []string{"Password", "Card.Number"}},
+	}})
+	cc := dialPipe(s, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType, Capabilities: option.CapMetadata})
+	defer func() { _ = cc.Close() }()
+
+	args := Login{User: "felix", Password: "secret"}
+	args.Card.Number, args.Card.Holder = "6222", "felix"
+	_ = cc.Write(&codec.Header{ServiceMethod: "User.Login", Seq: 1, Meta: map[string]string{common.MetaRequestID: "req-1"}}, args)
+	var h codec.Header
+	var reply bool
+	_ = cc.ReadHeader(&h)
+	_ = cc.ReadBody(&reply)
+
+	entry := <-rec.ch
+	_assert(entry["method"] == "User.Login" && entry["request_id"] == "req-1" && entry["code"] == "ok",
+		"unexpected access log: %v", entry)
+	_assert(entry["req_bytes"].(int64) > 0 && entry["resp_bytes"].(int64) > 0, "expect request and response sizes, got %v", entry)
+	logged, _ := json.Marshal(entry["args"])
+	want := `{"Card":{"Holder":"felix","Number":"[REDACTED]"},"Password":"[REDACTED]","User":"felix"}`
+	_assert(string(logged) == want, "expect redacted args %s, but got %s", want, logged)
+}
+
+func TestServer_Metrics(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	_ = s.Register(foo)
+	cc := dialPipe(s, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType})
+	defer func() { _ = cc.Close() }()
+
+	for seq, method := range []string{"Foo.Sum", "Foo.Sum", "Foo.Missing", "Bar.Sum"} {
+		_ = cc.Write(&codec.Header{ServiceMethod: method, Seq: uint64(seq)}, Args{Num1: 1, Num2: 2})
+		var h codec.Header
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(nil)
+	}
+	ts := httptest.NewServer(s.HandleHTTP())
+	defer ts.Close()
+	want := []string{
+		`fexrpc_server_requests_total{method="Foo.Sum"} 2`,
+		`fexrpc_server_requests_total{method="unknown"} 2`,
+		`fexrpc_server_errors_total{method="unknown",code="not found"} 2`,
+		`fexrpc_server_request_duration_seconds_count{method="Foo.Sum"} 2`,
+		`fexrpc_server_in_flight_requests{method="Foo.Sum"} 0`,
+		"fexrpc_server_connections 1",
+	}
+	scrape := func() (string, string) {
+		resp, err := http.Get(ts.URL + common.DefaultMetricsPath)
+		_assert(err == nil, "scrape metrics: %v", err)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		for _, line := range want {
+			if !strings.Contains(string(body), line) {
+				return string(body), line
+			}
+		}
+		return string(body), ""
+	}
+	// 指标在响应发送后记录，等待所有请求记录完成
+	text, missing := scrape()
+	for i := 0; i < 50 && missing != ""; i++ {
+		time.Sleep(time.Millisecond * 10)
+		text, missing = scrape()
+	}
+	_assert(missing == "", "expect %q in metrics:\n%s", missing, text)
+	_assert(!strings.Contains(text, `method="Foo.Missing"`), "unknown methods should not create series")
+}
+
+func TestServer_DebugJSON(t *testing.T) {
+	s := NewServer()
+	var arith Arith
+	_ = s.Register(arith)
+	cc := dialPipe(s, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType})
+	defer func() { _ = cc.Close() }()
+	for seq, args := range []Args{{1, 2}, {1, 0}, {3, 4}} {
+		var h codec.Header
+		_ = cc.Write(&codec.Header{ServiceMethod: "Arith.Div", Seq: uint64(seq)}, args)
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(nil)
+	}
+	ts := httptest.NewServer(s.HandleHTTP())
+	defer ts.Close()
+
+	var page debugJSONPage
+	var div debugJSONMethod
+	settled := func() bool {
+		return div.Latency.Samples == 3 && len(page.Conns.List) == 1 && page.Conns.List[0].Pending == 0
+	}
+	// 统计在响应发送后记录
+	for i := 0; i < 50 && !settled(); i++ {
+		page = debugJSONPage{}
+		resp, err := http.Get(ts.URL + common.DefaultDebugJSONPath)
+		_assert(err == nil, "get debug json: %v", err)
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		_assert(err == nil && len(page.Services) == 1, "unexpected debug json %+v, %v", page, err)
+		for _, m := range page.Services[0].Methods {
+			if m.Name == "Div" {
+				div = m
+			}
+		}
+		if !settled() {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	_assert(div.Calls == 3 && div.Latency.Samples == 3 && div.Latency.Max >= div.Latency.P50, "unexpected method stats %+v", div)
+	_assert(div.Errors.Total == 1 && div.Errors.ByCode["internal"] == 1 && strings.Contains(div.Errors.LastError, "internal error"),
+		"unexpected errors %+v", div.Errors)
+	_assert(page.UptimeSeconds > 0 && page.Conns.Active == 1 && len(page.Conns.List) == 1, "unexpected connections %+v", page.Conns)
+	conn := page.Conns.List[0]
+	_assert(conn.State == "serving" && conn.Codec == "gob" && conn.Pending == 0, "unexpected connection %+v", conn)
+}
+
+func TestServer_IdempotencyRetryAfterCancel(t *testing.T) {
+	s := NewServer()
+	var executed atomic.Int32
+	started := make(chan struct{})
+	_ = s.RegisterFunc("Pay.Charge", func(ctx context.Context, amount int, reply *int) error {
+		if executed.Add(1) == 1 {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		*reply = amount
+		return nil
+	})
+	cc := dialPipe(s, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType,
+		Capabilities: option.CapMetadata | option.CapCancellation})
+	defer func() { _ = cc.Close() }()
+
+	charge := func(seq uint64) (codec.Header, int) {
+		_ = cc.Write(&codec.Header{ServiceMethod: "Pay.Charge", Seq: seq, Meta: map[string]string{common.MetaIdempotencyKey: "order-1"}}, 100)
+		if seq == 1 {
+			<-started
+			_ = cc.Write(&codec.Header{ServiceMethod: common.CancelMethod, Seq: seq}, struct{}{})
+		}
+		var h codec.Header
+		var reply int
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(&reply)
+		return h, reply
+	}
+	h, _ := charge(1)
+	_assert(h.Code == common.CodeCanceled, "expect the first call to be canceled, but got %+v", h)
+	// 被取消的调用结束前到达的重试等待它的结果，之后的重试重新执行
+	var reply int
+	for seq := uint64(2); seq < 50 && h.Error != ""; seq++ {
+		h, reply = charge(seq)
+	}
+	_assert(h.Error == "" && reply == 100 && executed.Load() == 2, "retry should execute again, but got %+v %d", h, reply)
+}
+
+func TestServer_ShutdownBlockedWrite(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	_ = s.Register(foo)
+	cc := dialPipe(s, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType})
+	defer func() { _ = cc.Close() }()
+	// 客户端不读取响应，服务端的写入阻塞在连接上
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, Args{Num1: 1, Num2: 2})
+	time.Sleep(time.Millisecond * 50)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		_assert(err == context.DeadlineExceeded, "expect deadline exceeded, but got %v", err)
+	case <-time.After(time.Second * 2):
+		_assert(false, "shutdown should return when ctx is done")
+	}
+}
+
+func TestServer_ConcurrencyHoldsUntilHandlerReturns(t *testing.T) {
+	s := NewServer()
+	release := make(chan struct{})
+	defer close(release)
+	_ = s.RegisterFunc("Slow.Wait", func(_ int, reply *int) error {
+		<-release // 忽略 context，超时后仍在运行
+		return nil
+	})
+	_ = s.SetMethodConcurrency("Slow.Wait", 1)
+	cc := dialPipe(s, &option.Option{MagicNumber: option.MagicNumber, CodecType: codec.GobType, HandleTimeout: time.Millisecond * 50})
+	defer func() { _ = cc.Close() }()
+
+	call := func(seq uint64) codec.Header {
+		var h codec.Header
+		_ = cc.Write(&codec.Header{ServiceMethod: "Slow.Wait", Seq: seq}, 1)
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(nil)
+		return h
+	}
+	h := call(1)
+	_assert(h.Code == common.CodeDeadlineExceeded, "expect a timeout response, but got %+v", h)
+	time.Sleep(time.Millisecond * 50)
+	h = call(2)
+	_assert(h.Code == common.CodeResourceExhausted, "timed out handler should still hold the method slot, but got %+v", h)
+}
@@ -1,97 +1,165 @@
 package server
 
 import (
-	"go/ast"
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
 	"sync/atomic"
+	"time"
+
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/internal/dispatch"
+	"github.com/felixorbit/fexrpc/option"
 )
 
 type methodType struct {
-	method    reflect.Method
-	ArgType   reflect.Type
-	ReplyType reflect.Type
-	numCalls  uint64
-}
+	*dispatch.Method
+	numLate uint64 // 超时后才完成、结果被丢弃的调用次数
+
+	maxConcurrent int64 // 并发上限，0 表示不限制
+	running       int64 // 正在处理和排队的请求数
+
+	timeout    time.Duration // 方法级默认处理超时，0 表示使用服务端配置
+	maxTimeout time.Duration // 方法级最大处理超时，0 表示使用服务端配置
 
-func (m *methodType) NumCalls() uint64 {
-	return atomic.LoadUint64(&m.numCalls)
+	cacheTTL time.Duration // 结果缓存时间，0 表示不缓存
+	cache    *common.Cache // 按参数缓存的成功结果
+
+	stats methodStats // 耗时和错误统计，用于调试接口
 }
 
-func (m *methodType) newArgv() reflect.Value {
-	var argv reflect.Value
-	if m.ArgType.Kind() == reflect.Ptr {
-		argv = reflect.New(m.ArgType.Elem())
-	} else {
-		argv = reflect.New(m.ArgType).Elem()
-	}
-	return argv
+func (m *methodType) NumLate() uint64 {
+	return atomic.LoadUint64(&m.numLate)
 }
 
-func (m *methodType) newReplyv() reflect.Value {
-	replyv := reflect.New(m.ReplyType.Elem())
-	switch m.ReplyType.Elem().Kind() {
-	case reflect.Map:
-		replyv.Elem().Set(reflect.MakeMap(m.ReplyType.Elem()))
-	case reflect.Slice:
-		replyv.Elem().Set(reflect.MakeSlice(m.ReplyType.Elem(), 0, 0))
-	}
-	return replyv
+// Running 正在处理和排队的请求数
+func (m *methodType) Running() int64 {
+	return atomic.LoadInt64(&m.running)
 }
 
 type service struct {
-	name   string
-	val    reflect.Value // 结构体实例
-	typ    reflect.Type
-	method map[string]*methodType
+	impl       *dispatch.Service // 方法的注册和调用
+	name       string
+	method     map[string]*methodType
+	registered time.Time
 }
 
-func newService(obj interface{}) *service {
-	s := &service{}
-	s.val = reflect.ValueOf(obj)
-	s.name = reflect.Indirect(s.val).Type().Name()
-	s.typ = reflect.TypeOf(obj)
-	if !ast.IsExported(s.name) {
-		log.Fatalf("rpc server: %s is not a valid service name", s.name)
+func wrapService(ds *dispatch.Service) *service {
+	s := &service{impl: ds, name: ds.Name, registered: time.Now(), method: make(map[string]*methodType, len(ds.Method))}
+	for name, m := range ds.Method {
+		s.method[name] = &methodType{Method: m}
 	}
-	s.registerMethods()
 	return s
 }
 
-func (s *service) registerMethods() {
-	s.method = make(map[string]*methodType)
-	for i := 0; i < s.typ.NumMethod(); i++ {
-		method := s.typ.Method(i)
-		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
-			continue
-		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
-			continue
+// 创建服务实例，name 为空时使用类型名作为服务名
+func newService(obj interface{}, name string) (*service, error) {
+	ds, err := dispatch.NewService(obj, name)
+	if err != nil {
+		return nil, err
+	}
+	return wrapService(ds), nil
+}
+
+// 基于已有的函数服务（可以为 nil）创建一个新的函数服务，并加入 fn 作为 methodName 方法。
+// 已注册的服务不会被修改，已有方法的配置和统计保留
+func newFuncService(old *service, name, methodName string, fn interface{}) (*service, error) {
+	var oldService *dispatch.Service
+	if old != nil {
+		oldService = old.impl
+	}
+	ds, err := dispatch.NewFuncService(oldService, name, methodName, fn)
+	if err != nil {
+		return nil, err
+	}
+	s := wrapService(ds)
+	if old != nil {
+		s.registered = old.registered
+		for n, m := range old.method {
+			s.method[n] = m
 		}
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuildInType(argType) || !isExportedOrBuildInType(replyType) {
-			continue
+	}
+	return s, nil
+}
+
+// 服务所有方法正在处理的请求数
+func (s *service) running() int64 {
+	var n int64
+	for _, m := range s.method {
+		n += m.Running()
+	}
+	return n
+}
+
+// 应用注册时指定的方法配置，Method 为空时作用于所有方法。先应用服务级配置再应用方法级配置，
+// 只修改非 0 的字段，方法级配置在服务级配置的基础上细化
+func (s *service) applyOptions(opts ...*option.MethodOption) error {
+	for _, opt := range orderOptions(opts) {
+		methods := s.method
+		if opt.Method != "" {
+			m, ok := s.method[opt.Method]
+			if !ok {
+				return fmt.Errorf("rpc server: can't find method %s.%s", s.name, opt.Method)
+			}
+			methods = map[string]*methodType{opt.Method: m}
 		}
-		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+		for name, m := range methods {
+			mopt := opt
+			if opt.Method == "" && opt.CacheTTL > 0 && m.WithContext {
+				// 服务级的缓存配置跳过不支持缓存的方法，其余字段照常应用
+				wide := *opt
+				wide.CacheTTL = 0
+				mopt = &wide
+			}
+			if err := m.applyOption(mopt); err != nil {
+				return fmt.Errorf("rpc server: %s.%s: %w", s.name, name, err)
+			}
 		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
+	return nil
 }
 
-func isExportedOrBuildInType(t reflect.Type) bool {
-	return ast.IsExported(t.Name()) || t.PkgPath() == ""
+// 去掉 nil，服务级配置排在方法级配置之前，同一级别保持原有顺序
+func orderOptions(opts []*option.MethodOption) []*option.MethodOption {
+	ordered := make([]*option.MethodOption, 0, len(opts))
+	for _, opt := range opts {
+		if opt != nil && opt.Method == "" {
+			ordered = append(ordered, opt)
+		}
+	}
+	for _, opt := range opts {
+		if opt != nil && opt.Method != "" {
+			ordered = append(ordered, opt)
+		}
+	}
+	return ordered
 }
 
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
-	atomic.AddUint64(&m.numCalls, 1)
-	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.val, argv, replyv})
-	if errInter := returnValues[0].Interface(); errInter != nil {
-		return errInter.(error)
+// 服务端缓存由所有调用方共享，只按方法和参数区分。接收 context 的方法可能依据调用方身份或元数据返回结果，不允许缓存
+func (m *methodType) applyOption(opt *option.MethodOption) error {
+	if opt.CacheTTL > 0 && m.WithContext {
+		return errors.New("CacheTTL is not supported for methods taking a context.Context")
+	}
+	if opt.Timeout > 0 {
+		m.timeout = opt.Timeout
+	}
+	if opt.MaxTimeout > 0 {
+		m.maxTimeout = opt.MaxTimeout
+	}
+	if opt.CacheTTL > 0 {
+		m.cacheTTL = opt.CacheTTL
+		if m.cache == nil {
+			m.cache = common.NewCache(DefaultCacheEntries)
+		}
 	}
 	return nil
 }
+
+// DefaultCacheEntries 每个可缓存方法最多缓存的结果数
+const DefaultCacheEntries = 1000
+
+// 调用方法，ctx 仅传递给第一个参数为 context.Context 的方法。方法 panic 时返回 *dispatch.PanicError
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
+	return s.impl.Call(ctx, m.Method, argv, replyv)
+}
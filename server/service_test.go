@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/felixorbit/fexrpc/internal/dispatch"
 )
 
 type Args struct {
@@ -22,6 +26,32 @@ func (f Foo) sum(args Args, reply *int) error {
 	return nil
 }
 
+// Arith 除数为 0 时 Div 会 panic
+type Arith int
+
+func (a Arith) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (a Arith) Div(args Args, reply *int) error {
+	*reply = args.Num1 / args.Num2
+	return nil
+}
+
+// Sleeper 的方法接收 context，等待 ms 毫秒或 context 结束
+type Sleeper int
+
+func (s Sleeper) Wait(ctx context.Context, ms int, reply *int) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Millisecond * time.Duration(ms)):
+		*reply = ms
+		return nil
+	}
+}
+
 func _assert(condition bool, msg string, v ...interface{}) {
 	if !condition {
 		panic(fmt.Sprintf("assertion failed:"+msg, v...))
@@ -30,7 +60,7 @@ func _assert(condition bool, msg string, v ...interface{}) {
 
 func TestNewService(t *testing.T) {
 	var foo Foo
-	s := newService(foo)
+	s, _ := newService(foo, "")
 	_assert(len(s.method) == 1, "wrong service method, expected 1, but got %d", len(s.method))
 	mType := s.method["Sum"]
 	_assert(mType != nil, "wrong method, Sum shouldn't nil")
@@ -38,11 +68,35 @@ func TestNewService(t *testing.T) {
 
 func TestMethodType_Call(t *testing.T) {
 	var foo Foo
-	s := newService(foo)
+	s, _ := newService(foo, "")
 	mType := s.method["Sum"]
-	argv := mType.newArgv()
-	replyv := mType.newReplyv()
+	argv := mType.NewArgv()
+	replyv := mType.NewReplyv()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 2}))
-	err := s.call(mType, argv, replyv)
+	err := s.call(context.Background(), mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 3 && mType.NumCalls() == 1, "failed to call method")
 }
+
+func TestMethodType_CallPanic(t *testing.T) {
+	var arith Arith
+	s, _ := newService(arith, "")
+	mType := s.method["Div"]
+	argv := mType.NewArgv()
+	replyv := mType.NewReplyv()
+	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 0}))
+	err := s.call(context.Background(), mType, argv, replyv)
+	pe, ok := err.(*dispatch.PanicError)
+	_assert(ok && len(pe.Stack) > 0, "expect a recovered panic, but got %v", err)
+	_assert(mType.NumCalls() == 1 && mType.NumPanics() == 1, "panic should be counted")
+}
+
+func TestMethodType_CallWithContext(t *testing.T) {
+	var sleeper Sleeper
+	s, _ := newService(sleeper, "")
+	mType := s.method["Wait"]
+	_assert(mType != nil && mType.WithContext, "method with context should be registered")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.call(ctx, mType, reflect.ValueOf(time.Minute.Milliseconds()).Convert(mType.ArgType), mType.NewReplyv())
+	_assert(err == context.Canceled, "expect canceled, but got %v", err)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/felixorbit/fexrpc/common"
+)
+
+// latencySamples 每个方法保留的最近耗时样本数，用于计算调试接口中的分位数
+const latencySamples = 1024
+
+// methodStats 方法最近的耗时样本和错误统计
+type methodStats struct {
+	mu          sync.Mutex
+	latencies   [latencySamples]time.Duration // 环形缓冲区
+	count       uint64                        // 记录过的响应数
+	errors      map[common.Code]uint64
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// 响应后记录耗时和错误
+func (st *methodStats) observe(d time.Duration, code common.Code, errMsg string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.latencies[st.count%latencySamples] = d
+	st.count++
+	if errMsg == "" {
+		return
+	}
+	if code == common.CodeOK {
+		code = common.CodeUnknown
+	}
+	if st.errors == nil {
+		st.errors = make(map[common.Code]uint64)
+	}
+	st.errors[code]++
+	st.lastError, st.lastErrorAt = errMsg, time.Now()
+}
+
+// latencySummary 最近样本的耗时分位数，单位为毫秒
+type latencySummary struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50_ms"`
+	P90     float64 `json:"p90_ms"`
+	P99     float64 `json:"p99_ms"`
+	Max     float64 `json:"max_ms"`
+}
+
+type methodErrors struct {
+	Total       uint64            `json:"total"`
+	ByCode      map[string]uint64 `json:"by_code,omitempty"`
+	LastError   string            `json:"last_error,omitempty"`
+	LastErrorAt *time.Time        `json:"last_error_at,omitempty"`
+}
+
+func (st *methodStats) snapshot() (latencySummary, methodErrors) {
+	st.mu.Lock()
+	n := int(st.count)
+	if n > latencySamples {
+		n = latencySamples
+	}
+	samples := append([]time.Duration(nil), st.latencies[:n]...)
+	errs := methodErrors{LastError: st.lastError}
+	if len(st.errors) > 0 {
+		errs.ByCode = make(map[string]uint64, len(st.errors))
+		for code, count := range st.errors {
+			errs.ByCode[code.String()] = count
+			errs.Total += count
+		}
+	}
+	if !st.lastErrorAt.IsZero() {
+		at := st.lastErrorAt
+		errs.LastErrorAt = &at
+	}
+	st.mu.Unlock()
+
+	summary := latencySummary{Samples: n}
+	if n == 0 {
+		return summary, errs
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	percentile := func(p float64) float64 {
+		return milliseconds(samples[int(math.Ceil(p*float64(n)))-1])
+	}
+	summary.P50, summary.P90, summary.P99 = percentile(0.5), percentile(0.9), percentile(0.99)
+	summary.Max = milliseconds(samples[n-1])
+	return summary, errs
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
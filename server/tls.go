@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// AcceptTLS 使用 TLS 协议提供服务。config.ClientAuth 为 tls.RequireAndVerifyClientCert 时即为 mTLS，
+// 客户端证书中的身份可以通过 Peer.TLSIdentity 获取
+func (s *Server) AcceptTLS(lis net.Listener, config *tls.Config) {
+	s.Accept(tls.NewListener(lis, config))
+}
+
+// NewTLSConfig 创建服务端 TLS 配置，证书由 reloader 提供。clientCAs 不为 nil 时要求并校验客户端证书（mTLS）
+func NewTLSConfig(reloader *CertReloader, clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// CertReloader 从文件加载证书，文件更新后在下一次握手时自动重新加载，无需重启服务
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader 加载证书和私钥文件
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload 重新加载证书，加载失败时继续使用旧证书
+func (r *CertReloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// 文件有更新时重新加载
+func (r *CertReloader) certificate() (*tls.Certificate, error) {
+	r.mu.RLock()
+	cert, modTime := r.cert, r.modTime
+	r.mu.RUnlock()
+	if latest, err := r.latestModTime(); err == nil && !latest.Equal(modTime) {
+		if err = r.Reload(); err == nil {
+			r.mu.RLock()
+			cert = r.cert
+			r.mu.RUnlock()
+		}
+	}
+	return cert, nil
+}
+
+// GetCertificate 用于 tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// GetClientCertificate 用于客户端的 tls.Config.GetClientCertificate，mTLS 时客户端证书同样支持热加载
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// 从校验通过的对端证书中提取身份：依次使用 URI SAN、Subject CN、DNS SAN、Email
+func tlsIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	leaf := state.VerifiedChains[0][0]
+	switch {
+	case len(leaf.URIs) > 0:
+		return leaf.URIs[0].String()
+	case leaf.Subject.CommonName != "":
+		return leaf.Subject.CommonName
+	case len(leaf.DNSNames) > 0:
+		return leaf.DNSNames[0]
+	case len(leaf.EmailAddresses) > 0:
+		return leaf.EmailAddresses[0]
+	}
+	return ""
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"context"
+
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/trace"
+)
+
+// 为请求创建服务端 span，请求携带追踪上下文时作为调用方 span 的子节点。响应后结束
+func startServerSpan(sc *serverConn, req *request) *trace.Span {
+	ctx := context.Background()
+	if parent, err := trace.ParseTraceparent(req.h.Meta[common.MetaTraceparent]); err == nil {
+		ctx = trace.ContextWithRemote(ctx, parent)
+	}
+	_, span := trace.StartSpan(ctx, req.method, trace.KindServer)
+	span.SetAttribute(trace.AttrMethod, req.h.ServiceMethod)
+	if sc.peer.RemoteAddr != nil {
+		span.SetAttribute(trace.AttrPeer, sc.peer.RemoteAddr.String())
+	}
+	span.SetAttribute(trace.AttrRequestID, req.id)
+	return span
+}
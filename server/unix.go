@@ -0,0 +1,36 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// PeerCred Unix Domain Socket 对端进程的凭证
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// ListenUnix 在 path 上监听 Unix Domain Socket。如果 path 是上次运行残留的 socket 文件（没有进程在监听）会先删除，
+// path 被其他进程使用或不是 socket 文件时返回错误。监听器关闭时删除 socket 文件
+func ListenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("rpc server: %s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("rpc server: %s is in use", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// 通过 SO_PEERCRED 获取对端进程的凭证，不是 Unix Domain Socket 时返回 nil
+func peerCred(conn interface{}) *PeerCred {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return nil
+	}
+	return &PeerCred{PID: cred.Pid, UID: cred.Uid, GID: cred.Gid}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package server
+
+// 当前平台不支持获取对端进程凭证
+func peerCred(conn interface{}) *PeerCred {
+	return nil
+}
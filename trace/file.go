@@ -0,0 +1,38 @@
+package trace
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/felixorbit/fexrpc/logger"
+)
+
+// JSONFileExporter 将 span 以每行一个 JSON 对象的格式追加写入文件，用于本地调试
+type JSONFileExporter struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewJSONFileExporter(path string) (*JSONFileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONFileExporter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (e *JSONFileExporter) Export(span SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.enc.Encode(span); err != nil {
+		logger.Warn("trace: export span error", "err", err)
+	}
+}
+
+func (e *JSONFileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
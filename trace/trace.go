@@ -0,0 +1,233 @@
+// Package trace 分布式追踪。调用通过 Header.Meta 中 W3C traceparent 格式的值传递追踪上下文，
+// 服务端和客户端为每次调用创建 span，结束时交给 SetExporter 设置的导出器
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/felixorbit/fexrpc/common"
+)
+
+// TraceID 追踪 ID，同一次请求链路上的 span 相同
+type TraceID [16]byte
+
+// SpanID span ID
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+func (id SpanID) IsValid() bool  { return id != SpanID{} }
+
+func (id TraceID) MarshalText() ([]byte, error) { return []byte(id.String()), nil }
+func (id SpanID) MarshalText() ([]byte, error) {
+	if !id.IsValid() {
+		return nil, nil
+	}
+	return []byte(id.String()), nil
+}
+
+// SpanContext 跨进程传递的追踪上下文
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent 格式化为 W3C traceparent：version-traceid-spanid-flags
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+var errInvalidTraceparent = errors.New("trace: invalid traceparent")
+
+// ParseTraceparent 解析 W3C traceparent，未知版本按版本 00 的格式解析前四个字段
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, errInvalidTraceparent
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, errInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || !sc.IsValid() {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Kind span 的类型
+type Kind string
+
+const (
+	KindServer   Kind = "server"
+	KindClient   Kind = "client"
+	KindInternal Kind = "internal"
+)
+
+// 常用的 span 属性
+const (
+	AttrMethod    = "rpc.method"
+	AttrPeer      = "net.peer"
+	AttrRequestID = "rpc.request_id"
+)
+
+// SpanData 结束的 span，交给导出器
+type SpanData struct {
+	TraceID    TraceID           `json:"trace_id"`
+	SpanID     SpanID            `json:"span_id"`
+	ParentID   SpanID            `json:"parent_id"` // 根 span 为空
+	Name       string            `json:"name"`
+	Kind       Kind              `json:"kind"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Status     string            `json:"status"` // 状态码，见 common.Code.String
+	Error      string            `json:"error,omitempty"`
+}
+
+// Span 一次操作，通过 End 结束。nil 的 Span 可以安全调用所有方法
+type Span struct {
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+	sc    SpanContext
+}
+
+type spanKey struct{}
+
+// ContextWithSpan 返回携带 span 的 context，之后在该 context 上创建的 span 是它的子节点
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// FromContext 获取 context 中的 span，没有时返回 nil
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+type remoteKey struct{}
+
+// ContextWithRemote 返回携带远端追踪上下文的 context，之后创建的 span 继承它的 TraceID
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// StartSpan 在 ctx 中的 span 或远端追踪上下文下创建子 span，都没有时开始新的追踪
+func StartSpan(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	var parent SpanContext
+	if p := FromContext(ctx); p != nil {
+		parent = p.sc
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = remote
+	}
+	span := &Span{data: SpanData{Name: name, Kind: kind, Start: time.Now(), Status: common.CodeOK.String()}}
+	if parent.IsValid() {
+		span.sc = SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+		span.data.ParentID = parent.SpanID
+	} else {
+		_, _ = rand.Read(span.sc.TraceID[:])
+		span.sc.Sampled = true
+	}
+	_, _ = rand.Read(span.sc.SpanID[:])
+	span.data.TraceID, span.data.SpanID = span.sc.TraceID, span.sc.SpanID
+	return ContextWithSpan(ctx, span), span
+}
+
+// SpanContext span 的追踪上下文，用于传递给下游
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string)
+	}
+	s.data.Attributes[key] = value
+}
+
+// SetStatus 设置 span 的状态码和错误信息
+func (s *Span) SetStatus(code common.Code, msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Status, s.data.Error = code.String(), msg
+}
+
+// End 结束 span 并导出，重复调用时忽略
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	if e := exporter.Load(); e != nil && s.sc.Sampled {
+		e.Export(data)
+	}
+}
+
+// Exporter 导出结束的 span，需要并发安全
+type Exporter interface {
+	Export(span SpanData)
+}
+
+type exporterHolder struct {
+	Exporter
+}
+
+var exporter atomic.Pointer[exporterHolder]
+
+// SetExporter 设置 span 的导出器，nil 表示不导出。未设置导出器时仍然传递追踪上下文
+func SetExporter(e Exporter) {
+	if e == nil {
+		exporter.Store(nil)
+		return
+	}
+	exporter.Store(&exporterHolder{Exporter: e})
+}
@@ -0,0 +1,71 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/felixorbit/fexrpc/common"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed:"+msg, v...))
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(tp)
+	_assert(err == nil && sc.Sampled && sc.TraceID.String() == "4bf92f3577b34da6a3ce929d0e0e4736", "parse failed: %+v, %v", sc, err)
+	_assert(sc.Traceparent() == tp, "expect %s, but got %s", tp, sc.Traceparent())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		_, err = ParseTraceparent(invalid)
+		_assert(err != nil, "expect error for %q", invalid)
+	}
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	_assert(err == nil, "future versions may carry extra fields")
+}
+
+func TestJSONFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	e, err := NewJSONFileExporter(path)
+	_assert(err == nil, "create exporter: %v", err)
+	SetExporter(e)
+	defer SetExporter(nil)
+
+	ctx, parent := StartSpan(context.Background(), "parent", KindInternal)
+	_, child := StartSpan(ctx, "child", KindClient)
+	child.SetAttribute(AttrMethod, "Foo.Sum")
+	child.SetStatus(common.CodeNotFound, "not found")
+	child.End()
+	child.End()
+	parent.End()
+	_ = e.Close()
+
+	f, _ := os.Open(path)
+	defer func() { _ = f.Close() }()
+	var spans []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var span map[string]interface{}
+		_ = json.Unmarshal(scanner.Bytes(), &span)
+		spans = append(spans, span)
+	}
+	_assert(len(spans) == 2, "expect 2 spans, but got %d", len(spans))
+	_assert(spans[0]["name"] == "child" && spans[0]["status"] == "not found" && spans[0]["trace_id"] == spans[1]["trace_id"],
+		"unexpected child span %v", spans[0])
+	_assert(spans[0]["parent_id"] == spans[1]["span_id"] && spans[1]["parent_id"] == "", "unexpected parent ids %v %v", spans[0], spans[1])
+}
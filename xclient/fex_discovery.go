@@ -1,10 +1,11 @@
 package xclient
 
 import (
-	"log"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/felixorbit/fexrpc/logger"
 )
 
 // FexRegistryDiscovery 从注册中心获取服务列表并缓存
@@ -13,6 +14,7 @@ type FexRegistryDiscovery struct {
 	registry   string
 	timeout    time.Duration // 客户端维护的服务列表过期时间
 	lastUpdate time.Time     // 最后从注册中心更新的时间
+	httpClient *http.Client
 }
 
 const defaultUpdateTimeout = time.Second * 10
@@ -25,9 +27,17 @@ func NewFexRegistryDiscovery(registryAddr string, timeout time.Duration) *FexReg
 		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0)),
 		registry:             registryAddr,
 		timeout:              timeout,
+		httpClient:           http.DefaultClient,
 	}
 }
 
+// SetHTTPClient 设置访问注册中心的 HTTP 客户端，例如通过 memnet.HTTPClient 访问内存中的注册中心
+func (d *FexRegistryDiscovery) SetHTTPClient(httpClient *http.Client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.httpClient = httpClient
+}
+
 func (d *FexRegistryDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -42,12 +52,13 @@ func (d *FexRegistryDiscovery) Refresh() error {
 	if d.lastUpdate.Add(d.timeout).After(time.Now()) {
 		return nil
 	}
-	log.Println("rpc registry: refresh servers from registry", d.registry)
-	resp, err := http.Get(d.registry)
+	logger.Debug("rpc registry: refresh servers from registry", "registry", d.registry)
+	resp, err := d.httpClient.Get(d.registry)
 	if err != nil {
-		log.Println("rpc registry: refresh err: ", err)
+		logger.Warn("rpc registry: refresh error", "registry", d.registry, "err", err)
 		return err
 	}
+	_ = resp.Body.Close()
 	servers := strings.Split(resp.Header.Get("X-Fexrpc-Servers"), ",")
 	d.servers = make([]string, 0)
 	for _, server := range servers {
@@ -0,0 +1,28 @@
+package xclient
+
+import (
+	"time"
+
+	"github.com/felixorbit/fexrpc/metrics"
+)
+
+// XClient 指标记录在 metrics.Default 中，mode 为 call 或 broadcast，单个实例的调用记录在客户端指标中
+var (
+	xclientCalls = metrics.Default.Counter("fexrpc_xclient_calls_total",
+		"Calls made through XClient by method and mode.", "method", "mode")
+	xclientErrors = metrics.Default.Counter("fexrpc_xclient_errors_total",
+		"XClient calls that failed by method and mode.", "method", "mode")
+	xclientLatency = metrics.Default.Histogram("fexrpc_xclient_call_duration_seconds",
+		"Duration of XClient calls including discovery and dialing.", nil, "method", "mode")
+	xclientDialErrors = metrics.Default.Counter("fexrpc_xclient_dial_errors_total",
+		"Failed connection attempts by server address.", "addr")
+)
+
+// 记录一次 XClient 调用
+func observeCall(serviceMethod, mode string, start time.Time, err error) {
+	xclientCalls.With(serviceMethod, mode).Inc()
+	xclientLatency.With(serviceMethod, mode).Observe(time.Since(start).Seconds())
+	if err != nil {
+		xclientErrors.With(serviceMethod, mode).Inc()
+	}
+}
@@ -0,0 +1,29 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+
+	fexClient "github.com/felixorbit/fexrpc/client"
+	"github.com/felixorbit/fexrpc/common"
+	"github.com/felixorbit/fexrpc/trace"
+)
+
+// 为 XClient 的一次调用或广播创建 span，发往各个实例的调用作为它的子 span
+func startSpan(ctx context.Context, name, serviceMethod string) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, name, trace.KindInternal)
+	span.SetAttribute(trace.AttrMethod, serviceMethod)
+	return ctx, span
+}
+
+func endSpan(span *trace.Span, err error) {
+	if err != nil {
+		code := common.CodeUnavailable
+		var se *fexClient.ServerError
+		if errors.As(err, &se) {
+			code = se.Code
+		}
+		span.SetStatus(code, err.Error())
+	}
+	span.End()
+}
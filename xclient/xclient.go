@@ -4,9 +4,12 @@ import (
 	"context"
 	"github.com/felixorbit/fexrpc/option"
 	"reflect"
+	"strconv"
 	"sync"
+	"time"
 
 	fexClient "github.com/felixorbit/fexrpc/client"
+	"github.com/felixorbit/fexrpc/trace"
 )
 
 // XClient 封装 Client，屏蔽建立连接的实现，同时支持服务发现和负载均衡
@@ -50,6 +53,7 @@ func (xc *XClient) dial(addr string) (*fexClient.Client, error) {
 		var err error
 		client, err = fexClient.XDial(addr, xc.opt)
 		if err != nil {
+			xclientDialErrors.With(addr).Inc()
 			return nil, err
 		}
 		xc.clients[addr] = client
@@ -65,27 +69,40 @@ func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod strin
 	return client.Call(ctx, serviceMethod, args, reply)
 }
 
-func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) (err error) {
+	ctx, span := startSpan(ctx, "XClient.Call", serviceMethod)
+	defer func(start time.Time) {
+		observeCall(serviceMethod, "call", start, err)
+		endSpan(span, err)
+	}(time.Now())
 	rpcAddr, err := xc.d.Get(xc.mode)
 	if err != nil {
 		return err
 	}
+	span.SetAttribute(trace.AttrPeer, rpcAddr)
 	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
 }
 
 // Broadcast 将请求广播到所有服务实例
 // 任意一个实例发生错误，则返回错误；调用成功则返回其中一个结果
-func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) (err error) {
+	ctx, span := startSpan(ctx, "XClient.Broadcast", serviceMethod)
+	defer func(start time.Time) {
+		observeCall(serviceMethod, "broadcast", start, err)
+		endSpan(span, err)
+	}(time.Now())
 	servers, err := xc.d.GetAll()
 	if err != nil {
 		return err
 	}
+	span.SetAttribute("rpc.servers", strconv.Itoa(len(servers)))
 
 	var mu sync.Mutex
 	var e error
 	replyDone := reply == nil // reply 为 nil 时调用没有返回值，无需设置
 
 	ctx, cancel := context.WithCancel(ctx) // 有错误时快速失效
+	defer cancel()
 	var wg sync.WaitGroup
 	for _, addr := range servers {
 		wg.Add(1)
@@ -0,0 +1,167 @@
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/felixorbit/fexrpc/memnet"
+	"github.com/felixorbit/fexrpc/metrics"
+	"github.com/felixorbit/fexrpc/registry"
+	"github.com/felixorbit/fexrpc/server"
+	"github.com/felixorbit/fexrpc/trace"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed:"+msg, v...))
+	}
+}
+
+type Args struct {
+	Num1, Num2 int
+}
+
+type Foo struct {
+	id int
+}
+
+func (f *Foo) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (f *Foo) ID(_ int, reply *int) error {
+	*reply = f.id
+	return nil
+}
+
+// 在内存中启动注册中心和 n 个服务实例，返回注册中心地址
+func startMemCluster(t *testing.T, name string, n int) string {
+	regLis, err := memnet.Listen(name + "-registry")
+	_assert(err == nil, "listen registry failed: %v", err)
+	t.Cleanup(func() { _ = regLis.Close() })
+	go func() { _ = http.Serve(regLis, registry.NewFexRegistry(time.Minute)) }()
+	registryAddr := fmt.Sprintf("http://%s-registry/_fexrpc_/registry", name)
+
+	for i := 0; i < n; i++ {
+		srvName := fmt.Sprintf("%s-server-%d", name, i)
+		l, err := memnet.Listen(srvName)
+		_assert(err == nil, "listen server failed: %v", err)
+		srv := server.NewServer()
+		_ = srv.Register(&Foo{id: i})
+		go srv.Accept(l)
+		t.Cleanup(func() { _ = srv.Close() })
+		registry.HeartbeatWithClient(memnet.HTTPClient(), registryAddr, "mem@"+srvName, 0)
+	}
+	return registryAddr
+}
+
+func TestXClient_MemCluster(t *testing.T) {
+	registryAddr := startMemCluster(t, "xclient-test", 3)
+	d := NewFexRegistryDiscovery(registryAddr, 0)
+	d.SetHTTPClient(memnet.HTTPClient())
+	servers, err := d.GetAll()
+	_assert(err == nil && len(servers) == 3, "expect 3 servers from registry, but got %v, %v", servers, err)
+
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	ids := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		var id int
+		err := xc.Call(context.Background(), "Foo.ID", 0, &id)
+		_assert(err == nil, "call failed: %v", err)
+		ids[id] = true
+	}
+	_assert(len(ids) == 3, "round robin should reach every server, but got %v", ids)
+
+	var reply int
+	err = xc.Broadcast(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "broadcast failed: %d, %v", reply, err)
+}
+
+// 读取 metrics.Default 中序列的当前值，不存在时为 0
+func metricValue(series string) float64 {
+	var text strings.Builder
+	_ = metrics.Default.WriteText(&text)
+	for _, line := range strings.Split(text.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			v, _ := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			return v
+		}
+	}
+	return 0
+}
+
+func TestXClient_Metrics(t *testing.T) {
+	l, _ := memnet.Listen("xclient-metrics")
+	srv := server.NewServer()
+	_ = srv.Register(&Foo{})
+	go srv.Accept(l)
+	t.Cleanup(func() { _ = srv.Close() })
+
+	series := []string{
+		`fexrpc_xclient_calls_total{method="Foo.Sum",mode="broadcast"}`,
+		`fexrpc_xclient_errors_total{method="Foo.Sum",mode="broadcast"}`,
+		`fexrpc_xclient_dial_errors_total{addr="mem@xclient-metrics-down"}`,
+	}
+	before := make([]float64, len(series))
+	for i, name := range series {
+		before[i] = metricValue(name)
+	}
+	xc := NewXClient(NewMultiServerDiscovery([]string{"mem@xclient-metrics", "mem@xclient-metrics-down"}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var reply int
+	_ = xc.Broadcast(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_ = xc.Broadcast(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	for i, name := range series {
+		_assert(metricValue(name)-before[i] == 2, "expect %s to increase by 2, but got %v -> %v", name, before[i], metricValue(name))
+	}
+}
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []trace.SpanData
+}
+
+func (r *spanRecorder) Export(span trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func TestXClient_BroadcastTrace(t *testing.T) {
+	registryAddr := startMemCluster(t, "xclient-trace", 2)
+	d := NewFexRegistryDiscovery(registryAddr, 0)
+	d.SetHTTPClient(memnet.HTTPClient())
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	rec := &spanRecorder{}
+	trace.SetExporter(rec)
+	defer trace.SetExporter(nil)
+	var reply int
+	err := xc.Broadcast(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil, "broadcast failed: %v", err)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var root trace.SpanData
+	for _, span := range rec.spans {
+		if span.Name == "XClient.Broadcast" {
+			root = span
+		}
+	}
+	children := 0
+	for _, span := range rec.spans {
+		if span.Kind == trace.KindClient && span.ParentID == root.SpanID && span.TraceID == root.TraceID {
+			children++
+		}
+	}
+	_assert(root.Attributes["rpc.servers"] == "2" && children == 2, "expect a broadcast span with 2 client spans, got %+v", rec.spans)
+}